@@ -0,0 +1,313 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// circuit breaker defaults, used for fields left at zero
+const (
+	defaultCircuitWindow      = 10 * time.Second
+	defaultCircuitMinRequests = 10
+	defaultCircuitFailureRate = 0.5
+	defaultCircuitOpenTimeout = 30 * time.Second
+	circuitBuckets            = 10
+)
+
+// CircuitState is the state of the circuit for one host
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through while tracking their failure rate
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests immediately until OpenTimeout has passed
+	CircuitOpen
+	// CircuitHalfOpen lets a few probe requests through to decide whether to close again
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(state))
+}
+
+// ErrCircuitOpen matches, with errors.Is, the CircuitOpenError returned while a circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned, without a request being sent, while the circuit for Host is open
+type CircuitOpenError struct {
+	Host string
+	// RetryAt is when the circuit will let a probe request through
+	RetryAt time.Time
+}
+
+func (circuitError *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open until %s", circuitError.Host, circuitError.RetryAt.Format(time.RFC3339))
+}
+
+// Is makes errors.Is(err, ErrCircuitOpen) true for a CircuitOpenError
+func (circuitError *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// CircuitBreaker keeps a circuit for each remote host, so calls to a failing host fail fast instead
+// of each waiting for a timeout
+// a closed circuit opens when, over the rolling Window, at least MinRequests were made and the share
+// that failed reached FailureRate; after OpenTimeout it becomes half-open and lets HalfOpenRequests
+// probes through, closing again if they all succeed and reopening on the first failure
+// a request fails when it returns an error or a 5xx status; requests cancelled by their own context
+// are not counted
+// set the fields before the breaker is first used; it is safe for concurrent use
+type CircuitBreaker struct {
+	// Window is the rolling period failures are counted over, in ten slices; 10 seconds when zero
+	Window time.Duration
+	// MinRequests is the fewest requests in the window which can open the circuit; 10 when zero
+	MinRequests int
+	// FailureRate is the share of failed requests, between 0 and 1, which opens the circuit; 0.5 when zero
+	FailureRate float64
+	// OpenTimeout is how long the circuit stays open before probing; 30 seconds when zero
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of successful probes needed to close the circuit; 1 when zero
+	HalfOpenRequests int
+	// OnStateChange, if set, is called whenever a host's circuit changes state, for metrics or logs
+	OnStateChange func(host string, from, to CircuitState)
+
+	mutex    sync.Mutex
+	circuits map[string]*hostCircuit
+	now      func() time.Time
+}
+
+// circuitBucket counts the outcomes of requests during one slice of the window
+type circuitBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// hostCircuit is the circuit for one host
+type hostCircuit struct {
+	state     CircuitState
+	openedAt  time.Time
+	buckets   [circuitBuckets]circuitBucket
+	probes    int
+	successes int
+}
+
+// State returns the state of the circuit for host
+func (breaker *CircuitBreaker) State(host string) CircuitState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	circuit, ok := breaker.circuits[host]
+	if !ok {
+		return CircuitClosed
+	}
+	if circuit.state == CircuitOpen && !breaker.clock().Before(circuit.openedAt.Add(breaker.openTimeout())) {
+		return CircuitHalfOpen
+	}
+	return circuit.state
+}
+
+// Do sends request with httpClient, unless the circuit for the request's host is open
+func (breaker *CircuitBreaker) Do(httpClient *http.Client, request *http.Request) (*http.Response, error) {
+	host := request.URL.Host
+	if err := breaker.allow(host); err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Do(request)
+	switch {
+	case err != nil && request.Context().Err() != nil:
+		// the caller gave up, which says nothing about the host
+		breaker.release(host)
+	case err != nil || response.StatusCode >= http.StatusInternalServerError:
+		breaker.record(host, false)
+	default:
+		breaker.record(host, true)
+	}
+	return response, err
+}
+
+// allow decides whether a request to host may be sent
+func (breaker *CircuitBreaker) allow(host string) error {
+	breaker.mutex.Lock()
+	circuit := breaker.circuit(host)
+	from := circuit.state
+
+	if circuit.state == CircuitOpen {
+		retryAt := circuit.openedAt.Add(breaker.openTimeout())
+		if breaker.clock().Before(retryAt) {
+			breaker.mutex.Unlock()
+			return &CircuitOpenError{Host: host, RetryAt: retryAt}
+		}
+		circuit.state, circuit.probes, circuit.successes = CircuitHalfOpen, 0, 0
+	}
+
+	if circuit.state == CircuitHalfOpen {
+		if circuit.probes >= breaker.halfOpenRequests() {
+			breaker.mutex.Unlock()
+			breaker.notify(host, from, circuit.state)
+			return &CircuitOpenError{Host: host, RetryAt: breaker.clock()}
+		}
+		circuit.probes++
+	}
+	to := circuit.state
+	breaker.mutex.Unlock()
+
+	breaker.notify(host, from, to)
+	return nil
+}
+
+// release gives back a half-open probe whose outcome is not counted
+func (breaker *CircuitBreaker) release(host string) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	circuit := breaker.circuit(host)
+	if circuit.state == CircuitHalfOpen && circuit.probes > 0 {
+		circuit.probes--
+	}
+}
+
+// record counts the outcome of a request to host, changing the state of its circuit if needed
+func (breaker *CircuitBreaker) record(host string, success bool) {
+	breaker.mutex.Lock()
+	circuit := breaker.circuit(host)
+	from := circuit.state
+	now := breaker.clock()
+
+	switch circuit.state {
+	case CircuitHalfOpen:
+		if !success {
+			circuit.state, circuit.openedAt = CircuitOpen, now
+			break
+		}
+		circuit.successes++
+		if circuit.successes >= breaker.halfOpenRequests() {
+			circuit.state = CircuitClosed
+			circuit.buckets = [circuitBuckets]circuitBucket{}
+		}
+	case CircuitClosed:
+		bucket := breaker.bucket(circuit, now)
+		if success {
+			bucket.successes++
+		} else {
+			bucket.failures++
+		}
+
+		successes, failures := breaker.totals(circuit, now)
+		total := successes + failures
+		if !success && total >= breaker.minRequests() && float64(failures)/float64(total) >= breaker.failureRate() {
+			circuit.state, circuit.openedAt = CircuitOpen, now
+		}
+	}
+	to := circuit.state
+	breaker.mutex.Unlock()
+
+	breaker.notify(host, from, to)
+}
+
+// bucket returns the bucket for the current slice of the window, resetting it if it is stale
+func (breaker *CircuitBreaker) bucket(circuit *hostCircuit, now time.Time) *circuitBucket {
+	// a window shorter than circuitBuckets nanoseconds would give buckets no width at all
+	width := max(breaker.window()/circuitBuckets, 1)
+	start := now.Truncate(width)
+	bucket := &circuit.buckets[(start.UnixNano()/int64(width))%circuitBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+	return bucket
+}
+
+// totals adds up the buckets which are still inside the window
+func (breaker *CircuitBreaker) totals(circuit *hostCircuit, now time.Time) (int, int) {
+	successes, failures := 0, 0
+	cutoff := now.Add(-breaker.window())
+	for _, bucket := range circuit.buckets {
+		if bucket.start.After(cutoff) {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	return successes, failures
+}
+
+// circuit returns the circuit for host, creating it closed; the mutex must be held
+func (breaker *CircuitBreaker) circuit(host string) *hostCircuit {
+	if breaker.circuits == nil {
+		breaker.circuits = make(map[string]*hostCircuit)
+	}
+	circuit, ok := breaker.circuits[host]
+	if !ok {
+		circuit = &hostCircuit{}
+		breaker.circuits[host] = circuit
+	}
+	return circuit
+}
+
+// notify calls OnStateChange if the state changed
+func (breaker *CircuitBreaker) notify(host string, from, to CircuitState) {
+	if from != to && breaker.OnStateChange != nil {
+		breaker.OnStateChange(host, from, to)
+	}
+}
+
+func (breaker *CircuitBreaker) clock() time.Time {
+	if breaker.now != nil {
+		return breaker.now()
+	}
+	return time.Now()
+}
+
+func (breaker *CircuitBreaker) window() time.Duration {
+	if breaker.Window > 0 {
+		return breaker.Window
+	}
+	return defaultCircuitWindow
+}
+
+func (breaker *CircuitBreaker) minRequests() int {
+	if breaker.MinRequests > 0 {
+		return breaker.MinRequests
+	}
+	return defaultCircuitMinRequests
+}
+
+func (breaker *CircuitBreaker) failureRate() float64 {
+	if breaker.FailureRate > 0 {
+		return breaker.FailureRate
+	}
+	return defaultCircuitFailureRate
+}
+
+func (breaker *CircuitBreaker) openTimeout() time.Duration {
+	if breaker.OpenTimeout > 0 {
+		return breaker.OpenTimeout
+	}
+	return defaultCircuitOpenTimeout
+}
+
+func (breaker *CircuitBreaker) halfOpenRequests() int {
+	if breaker.HalfOpenRequests > 0 {
+		return breaker.HalfOpenRequests
+	}
+	return 1
+}
+
+// sendOnce sends request with httpClient, through breaker if there is one
+func sendOnce(httpClient *http.Client, request *http.Request, breaker *CircuitBreaker) (*http.Response, error) {
+	if breaker == nil {
+		return httpClient.Do(request)
+	}
+	return breaker.Do(httpClient, request)
+}
@@ -0,0 +1,143 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock for CircuitBreaker.now
+type testClock struct {
+	current time.Time
+}
+
+func (clock *testClock) now() time.Time {
+	return clock.current
+}
+
+func TestCircuitBreaker(test *testing.T) {
+	var healthy atomic.Bool
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if !healthy.Load() {
+			responseWriter.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		responseWriter.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	clock := &testClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var transitions []string
+	breaker := &CircuitBreaker{MinRequests: 4, FailureRate: 0.5, OpenTimeout: 5 * time.Second, now: clock.now,
+		OnStateChange: func(host string, from, to CircuitState) {
+			transitions = append(transitions, fmt.Sprintf("%s->%s", from, to))
+		},
+	}
+	testTools := Tools{RemoteCircuitBreaker: breaker}
+	remoteURI, _ := url.Parse(server.URL)
+
+	for idx := 0; idx < 4; idx++ {
+		if _, status, err := testTools.PostJSONToRemote(*remoteURI, nil); err != nil || status != http.StatusInternalServerError {
+			test.Fatalf("request %d: expected a 500 but got %d, %v", idx, status, err)
+		}
+	}
+	if state := breaker.State(remoteURI.Host); state != CircuitOpen {
+		test.Fatalf("expected the circuit to open but it is %s", state)
+	}
+
+	_, _, err := testTools.PostJSONToRemote(*remoteURI, nil)
+	var circuitError *CircuitOpenError
+	if !errors.As(err, &circuitError) || !errors.Is(err, ErrCircuitOpen) || circuitError.Host != remoteURI.Host {
+		test.Errorf("expected a CircuitOpenError but got %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 4 {
+		test.Errorf("expected the open circuit to stop the request, but the server saw %d", requests)
+	}
+
+	// a failed probe reopens the circuit
+	clock.current = clock.current.Add(6 * time.Second)
+	_, _, _ = testTools.PostJSONToRemote(*remoteURI, nil)
+	if state := breaker.State(remoteURI.Host); state != CircuitOpen {
+		test.Errorf("expected a failed probe to reopen the circuit but it is %s", state)
+	}
+
+	// a successful probe closes it
+	healthy.Store(true)
+	clock.current = clock.current.Add(6 * time.Second)
+	if _, status, err := testTools.PostJSONToRemote(*remoteURI, nil); err != nil || status != http.StatusOK {
+		test.Errorf("expected the probe to succeed but got %d, %v", status, err)
+	}
+	if state := breaker.State(remoteURI.Host); state != CircuitClosed {
+		test.Errorf("expected a successful probe to close the circuit but it is %s", state)
+	}
+
+	expected := "[closed->open open->half-open half-open->open open->half-open half-open->closed]"
+	if fmt.Sprint(transitions) != expected {
+		test.Errorf("expected transitions %s but got %v", expected, transitions)
+	}
+}
+
+func TestCircuitBreakerWindow(test *testing.T) {
+	clock := &testClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := &CircuitBreaker{MinRequests: 4, Window: 10 * time.Second, now: clock.now}
+
+	// failures spread beyond the window never reach the threshold together
+	for idx := 0; idx < 10; idx++ {
+		breaker.record("example.com", true)
+		breaker.record("example.com", true)
+		breaker.record("example.com", false)
+		clock.current = clock.current.Add(4 * time.Second)
+	}
+	if state := breaker.State("example.com"); state != CircuitClosed {
+		test.Errorf("expected a one in three failure rate to keep the circuit closed but it is %s", state)
+	}
+
+	breaker.record("other.com", false)
+	breaker.record("other.com", false)
+	breaker.record("other.com", false)
+	if state := breaker.State("other.com"); state != CircuitClosed {
+		test.Errorf("expected fewer than MinRequests to keep the circuit closed but it is %s", state)
+	}
+	breaker.record("other.com", false)
+	if state := breaker.State("other.com"); state != CircuitOpen {
+		test.Errorf("expected the circuit to open but it is %s", state)
+	}
+	if state := breaker.State("example.com"); state != CircuitClosed {
+		test.Errorf("expected circuits to be per host but example.com is %s", state)
+	}
+}
+
+func TestCircuitBreakerTinyWindow(test *testing.T) {
+	clock := &testClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := &CircuitBreaker{MinRequests: 1, Window: 5 * time.Nanosecond, now: clock.now}
+
+	breaker.record("example.com", false)
+	if state := breaker.State("example.com"); state != CircuitOpen {
+		test.Errorf("expected the circuit to open but it is %s", state)
+	}
+}
+
+func TestJSONClientCircuitBreakerStopsRetries(test *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		responseWriter.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client, _ := NewJSONClient(server.URL)
+	client.Retry = &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond}
+	client.CircuitBreaker = &CircuitBreaker{MinRequests: 2}
+	_, err := client.Get(context.Background(), "/", nil)
+	if !errors.Is(err, ErrCircuitOpen) || atomic.LoadInt32(&requests) != 2 {
+		test.Errorf("expected the circuit to stop retries after 2 requests but got %v after %d", err, requests)
+	}
+}
@@ -0,0 +1,353 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// default limit on the size of a response body JSONClient reads
+const defaultMaxResponseSize = 10 * megabyte
+
+// default timeout of the http.Client JSONClient creates
+const defaultClientTimeout = 30 * time.Second
+
+// AuthFunc adds credentials to an outgoing request
+type AuthFunc func(request *http.Request) error
+
+// BearerToken authenticates requests with an Authorization: Bearer header
+func BearerToken(token string) AuthFunc {
+	return func(request *http.Request) error {
+		request.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+// BasicAuth authenticates requests with HTTP basic authentication
+func BasicAuth(username, password string) AuthFunc {
+	return func(request *http.Request) error {
+		request.SetBasicAuth(username, password)
+		return nil
+	}
+}
+
+// HTTPError is returned by JSONClient when the remote answers with a status outside 2xx
+// Message, Code and RequestID are filled from a JSONResponse error body, and Problem from an
+// application/problem+json body; Body always holds the raw body
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Message    string
+	Code       string
+	RequestID  string
+	Problem    *ProblemDetails
+	Body       []byte
+}
+
+func (httpError *HTTPError) Error() string {
+	message := fmt.Sprintf("%s %s: %s", httpError.Method, httpError.URL, httpError.Status)
+	if httpError.Message != "" {
+		message += ": " + httpError.Message
+	}
+	return message
+}
+
+// ResponseError is returned when a remote's response body can not be read or decoded
+// Err is usually a *JSONError saying why, such as a body over the size limit, a Content-Type which is
+// not JSON, badly-formed JSON or a field of the wrong type
+// its StatusCode is 502 Bad Gateway, so passing it to ErrorJSON does not blame the caller's request,
+// and as its text names the remote URL, it is masked as unknown errors are
+type ResponseError struct {
+	Method       string
+	URL          string
+	RemoteStatus int
+	Err          error
+}
+
+func (responseError *ResponseError) Error() string {
+	return fmt.Sprintf("reading response from %s %s: %s", responseError.Method, responseError.URL, responseError.Err)
+}
+
+func (responseError *ResponseError) Unwrap() error {
+	return responseError.Err
+}
+
+// StatusCode is the HTTP status ErrorJSON uses for the error when none is given
+func (responseError *ResponseError) StatusCode() int {
+	return http.StatusBadGateway
+}
+
+func (responseError *ResponseError) internalError() {}
+
+// newResponseError wraps a failure to read or decode response
+func newResponseError(response *http.Response, err error) *ResponseError {
+	responseError := &ResponseError{RemoteStatus: response.StatusCode, Err: err}
+	if response.Request != nil {
+		responseError.Method, responseError.URL = response.Request.Method, response.Request.URL.String()
+	}
+	return responseError
+}
+
+// JSONClient calls JSON APIs, sending request bodies as JSON and decoding replies
+// one client is safe for concurrent use, and reuses its http.Client's connections between calls
+type JSONClient struct {
+	// BaseURL is what relative request paths are resolved against
+	BaseURL *url.URL
+	// HTTPClient sends the requests; NewJSONClient sets one with a 30 second timeout
+	HTTPClient *http.Client
+	// Header is added to every request
+	Header http.Header
+	// Auth, if set, adds credentials to every request
+	Auth AuthFunc
+	// TokenSource, if set, supplies the Authorization header of every request; a request rejected
+	// with 401 Unauthorized is sent once more with a new token (see TokenSource)
+	TokenSource TokenSource
+	// MaxResponseSize limits the bytes read from a response body, both before and after it is
+	// decompressed; 10 megabytes when zero
+	MaxResponseSize int64
+	// DisallowUnknownFields fails decoding when a reply has a field out does not
+	DisallowUnknownFields bool
+	// AllowAnyContentType decodes replies whatever their Content-Type; by default replies which are
+	// decoded must be application/json (or +json) in UTF-8
+	AllowAnyContentType bool
+	// Retry, if set, retries failed requests (see RetryPolicy)
+	Retry *RetryPolicy
+	// CircuitBreaker, if set, fails requests to a failing host fast (see CircuitBreaker)
+	CircuitBreaker *CircuitBreaker
+	// Signer, if set, signs every request body (see WebhookSigner)
+	Signer *WebhookSigner
+}
+
+// NewJSONClient creates a JSONClient for the API at baseURL
+func NewJSONClient(baseURL string) (*JSONClient, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		// so relative paths are resolved beneath the whole base path
+		base.Path += "/"
+	}
+	return &JSONClient{
+		BaseURL:    base,
+		HTTPClient: &http.Client{Timeout: defaultClientTimeout},
+		Header:     make(http.Header),
+	}, nil
+}
+
+// Get sends a GET request and decodes the reply into out
+func (client *JSONClient) Get(ctx context.Context, path string, out interface{}) (*http.Response, error) {
+	return client.Do(ctx, http.MethodGet, path, nil, out)
+}
+
+// Post sends body as JSON with a POST request and decodes the reply into out
+func (client *JSONClient) Post(ctx context.Context, path string, body, out interface{}) (*http.Response, error) {
+	return client.Do(ctx, http.MethodPost, path, body, out)
+}
+
+// Put sends body as JSON with a PUT request and decodes the reply into out
+func (client *JSONClient) Put(ctx context.Context, path string, body, out interface{}) (*http.Response, error) {
+	return client.Do(ctx, http.MethodPut, path, body, out)
+}
+
+// Patch sends body as JSON with a PATCH request and decodes the reply into out
+func (client *JSONClient) Patch(ctx context.Context, path string, body, out interface{}) (*http.Response, error) {
+	return client.Do(ctx, http.MethodPatch, path, body, out)
+}
+
+// Delete sends a DELETE request and decodes the reply into out
+func (client *JSONClient) Delete(ctx context.Context, path string, out interface{}) (*http.Response, error) {
+	return client.Do(ctx, http.MethodDelete, path, nil, out)
+}
+
+// Do sends a request to path, resolved against BaseURL, with body encoded as JSON unless it is nil
+// a 2xx reply is decoded into out unless out is nil or the reply has no body; out may be a
+// *JSONResponse (with Data set to a pointer to decode the data member into) or a *Response[T]
+// any other status is returned as an *HTTPError along with the response
+// gzip and deflate replies are decompressed; a reply which is too large, compressed in another way,
+// or can not be decoded is returned as a *ResponseError
+// the returned response's body has already been read, decompressed and closed, but can be read again
+func (client *JSONClient) Do(ctx context.Context, method, path string, body, out interface{}) (*http.Response, error) {
+	request, err := client.newRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return client.send(request, client.Retry, client.Signer, out)
+}
+
+// send sends a prepared request, retrying as policy describes and signing each attempt with signer,
+// and decodes the reply into out
+func (client *JSONClient) send(request *http.Request, policy *RetryPolicy, signer *WebhookSigner, out interface{}) (*http.Response, error) {
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := sendWithToken(httpClient, request, client.TokenSource, policy, client.CircuitBreaker, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	responseBody, err := readResponseBody(response, client.MaxResponseSize)
+	if err != nil {
+		return response, newResponseError(response, err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response, newHTTPError(request, response, responseBody)
+	}
+	if out == nil || len(bytes.TrimSpace(responseBody)) == 0 {
+		return response, nil
+	}
+	if err := decodeResponseJSON(response, responseBody, out, client.MaxResponseSize, !client.DisallowUnknownFields, !client.AllowAnyContentType); err != nil {
+		return response, newResponseError(response, err)
+	}
+	return response, nil
+}
+
+// resolve resolves path against BaseURL
+func (client *JSONClient) resolve(path string) (string, error) {
+	target, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	if client.BaseURL != nil {
+		target = client.BaseURL.ResolveReference(target)
+	}
+	return target.String(), nil
+}
+
+// newRequest builds a JSON request with the client's headers and credentials
+func (client *JSONClient) newRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	target, err := client.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		requestBody = bytes.NewReader(jsonData)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, target, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if err := client.prepare(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// prepare adds the client's headers, where request does not already have them, and credentials
+func (client *JSONClient) prepare(request *http.Request) error {
+	for key, values := range client.Header {
+		if _, ok := request.Header[key]; !ok {
+			request.Header[key] = append([]string(nil), values...)
+		}
+	}
+	if request.Header.Get("Accept") == "" {
+		request.Header.Set("Accept", "application/json, application/problem+json;q=0.9")
+	}
+	if request.Header.Get("Accept-Encoding") == "" {
+		// asked for explicitly, so replies are decompressed here, within MaxResponseSize
+		request.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	if client.Auth != nil {
+		return client.Auth(request)
+	}
+	return nil
+}
+
+// readResponseBody reads, decompresses and closes a response body, leaving a copy of the decompressed
+// body in its place so it can be read again
+// the body may not be larger than maxSize bytes either before or after decompression
+func readResponseBody(response *http.Response, maxSize int64) ([]byte, error) {
+	defer response.Body.Close()
+
+	if maxSize <= 0 {
+		maxSize = defaultMaxResponseSize
+	}
+	contentEncoding := response.Header.Get("Content-Encoding")
+	body, closeBody, err := decompressBody(http.MaxBytesReader(nil, response.Body, maxSize), contentEncoding, nil, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody()
+
+	responseBody, err := io.ReadAll(body)
+	if err != nil {
+		return nil, classifyJSONError(err, nil, 0, maxSize)
+	}
+
+	if contentEncoding != "" {
+		// as net/http does when it decompresses a response itself
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		response.ContentLength = int64(len(responseBody))
+		response.Uncompressed = true
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+	return responseBody, nil
+}
+
+// decodeResponseJSON decodes a response body into out, with the same error classification as ReadJSON
+func decodeResponseJSON(response *http.Response, responseBody []byte, out interface{}, maxSize int64, allowUnknownFields, checkContentType bool) error {
+	if checkContentType {
+		if err := checkJSONContentType(response.Header.Get("Content-Type")); err != nil {
+			return err
+		}
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxResponseSize
+	}
+	return decodeJSON(bytes.NewReader(responseBody), out, jsonDecodeOptions{maxBytes: maxSize, allowUnknownFields: allowUnknownFields})
+}
+
+// newHTTPError describes a non 2xx response, decoding the error body when it is JSON
+func newHTTPError(request *http.Request, response *http.Response, responseBody []byte) *HTTPError {
+	httpError := &HTTPError{
+		Method:     request.Method,
+		URL:        request.URL.String(),
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Header:     response.Header,
+		Body:       responseBody,
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/problem+json":
+		var problem ProblemDetails
+		if json.Unmarshal(responseBody, &problem) == nil {
+			httpError.Problem = &problem
+			httpError.Message = problem.Error()
+			httpError.Code, _ = problem.Extensions["code"].(string)
+			httpError.RequestID, _ = problem.Extensions["request_id"].(string)
+		}
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var payload JSONResponse
+		if json.Unmarshal(responseBody, &payload) == nil {
+			httpError.Message = payload.Message
+			httpError.Code = payload.Code
+			httpError.RequestID = payload.RequestID
+		}
+	}
+	return httpError
+}
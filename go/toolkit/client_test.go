@@ -0,0 +1,240 @@
+package toolkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestAPI() *httptest.Server {
+	testTools := Tools{ValidateJSON: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/items/7", func(responseWriter http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer secret" || request.Header.Get("X-Client") != "tests" {
+			_ = testTools.ErrorJSON(responseWriter, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		switch request.Method {
+		case http.MethodGet:
+			_ = WriteJSONAs(&testTools, responseWriter, http.StatusOK, envelopeItem{ID: 7, Name: "seven"})
+		case http.MethodPut:
+			item, err := ReadJSONAs[envelopeItem](&testTools, responseWriter, request)
+			if err != nil {
+				_ = testTools.ErrorJSON(responseWriter, err)
+				return
+			}
+			_ = testTools.WriteJSON(responseWriter, http.StatusOK, item)
+		case http.MethodDelete:
+			responseWriter.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/api/v1/problem", func(responseWriter http.ResponseWriter, request *http.Request) {
+		problemTools := Tools{UseProblemJSON: true}
+		_ = problemTools.ErrorJSON(responseWriter, &ProblemDetails{Title: "Out of credit", Status: http.StatusForbidden, Detail: "balance is 30"})
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestClient(test *testing.T, server *httptest.Server) *JSONClient {
+	client, err := NewJSONClient(server.URL + "/api/v1")
+	if err != nil {
+		test.Fatal(err)
+	}
+	client.Header.Set("X-Client", "tests")
+	client.Auth = BearerToken("secret")
+	return client
+}
+
+func TestJSONClient(test *testing.T) {
+	server := newTestAPI()
+	defer server.Close()
+	client := newTestClient(test, server)
+	ctx := context.Background()
+
+	var envelope Response[envelopeItem]
+	response, err := client.Get(ctx, "items/7", &envelope)
+	if err != nil || envelope.Data.Name != "seven" {
+		test.Errorf("unexpected GET result %+v, %v", envelope, err)
+	}
+	if body, _ := io.ReadAll(response.Body); len(body) == 0 {
+		test.Error("expected the response body to be readable again")
+	}
+
+	var item envelopeItem
+	payload := JSONResponse{Data: &item}
+	if _, err := client.Get(ctx, "items/7", &payload); err != nil || item.ID != 7 {
+		test.Errorf("expected data decoded through JSONResponse but got %+v, %v", item, err)
+	}
+
+	var updated envelopeItem
+	if _, err := client.Put(ctx, "items/7", envelopeItem{ID: 7, Name: "renamed"}, &updated); err != nil || updated.Name != "renamed" {
+		test.Errorf("unexpected PUT result %+v, %v", updated, err)
+	}
+
+	response, err = client.Delete(ctx, "items/7", &updated)
+	if err != nil || response.StatusCode != http.StatusNoContent {
+		test.Errorf("unexpected DELETE result %v", err)
+	}
+}
+
+func TestJSONClientErrors(test *testing.T) {
+	server := newTestAPI()
+	defer server.Close()
+	client := newTestClient(test, server)
+	ctx := context.Background()
+
+	var httpError *HTTPError
+	_, err := client.Put(ctx, "items/7", map[string]int{"id": 7}, nil)
+	if !errors.As(err, &httpError) || httpError.StatusCode != http.StatusUnprocessableEntity || httpError.Message == "" || httpError.RequestID == "" {
+		test.Errorf("expected a decoded 422 error but got %#v", err)
+	}
+
+	_, err = client.Get(ctx, "problem", nil)
+	if !errors.As(err, &httpError) || httpError.Problem == nil || httpError.Message != "balance is 30" {
+		test.Errorf("expected a decoded problem but got %#v", err)
+	}
+
+	client.Auth = nil
+	_, err = client.Get(ctx, "items/7", nil)
+	if !errors.As(err, &httpError) || httpError.StatusCode != http.StatusUnauthorized || httpError.Message != "unauthorized" {
+		test.Errorf("expected a 401 error but got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Get(cancelled, "items/7", nil); !errors.Is(err, context.Canceled) {
+		test.Errorf("expected context.Canceled but got %v", err)
+	}
+}
+
+// gzipped compresses data for a test response
+func gzipped(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	return compressed.Bytes()
+}
+
+// zlibbed compresses data as HTTP deflate for a test response
+func zlibbed(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	return compressed.Bytes()
+}
+
+var clientDecodingTests = []struct {
+	name          string
+	contentType   string
+	encoding      string
+	body          []byte
+	disallow      bool
+	anyType       bool
+	expectedKind  JSONErrorKind
+	expectedValue int
+}{
+	{name: "plain", contentType: "application/json", body: []byte(`{"id":1,"extra":true}`), expectedValue: 1},
+	{name: "gzip", contentType: "application/json", encoding: "gzip", body: gzipped([]byte(`{"id":2}`)), expectedValue: 2},
+	{name: "deflate", contentType: "application/json", encoding: "deflate", body: zlibbed([]byte(`{"id":11}`)), expectedValue: 11},
+	{name: "too large", contentType: "application/json", body: []byte(`{"id":3,"padding":"` + strings.Repeat("x", 100) + `"}`), expectedKind: JSONErrorTooLarge},
+	{name: "compression bomb", contentType: "application/json", encoding: "gzip", body: gzipped([]byte(`{"id":4,"padding":"` + strings.Repeat("x", 10000) + `"}`)), expectedKind: JSONErrorDecompressedTooLarge},
+	{name: "corrupt gzip", contentType: "application/json", encoding: "gzip", body: []byte("not gzip at all"), expectedKind: JSONErrorCorruptEncoding},
+	{name: "unsupported encoding", contentType: "application/json", encoding: "br", body: []byte(`{"id":5}`), expectedKind: JSONErrorUnsupportedEncoding},
+	{name: "wrong content type", contentType: "text/html", body: []byte(`{"id":6}`), expectedKind: JSONErrorUnsupportedMediaType},
+	{name: "any content type", contentType: "text/plain", anyType: true, body: []byte(`{"id":7}`), expectedValue: 7},
+	{name: "syntax", contentType: "application/json", body: []byte(`{"id":8,}`), expectedKind: JSONErrorSyntax},
+	{name: "wrong type", contentType: "application/json", body: []byte(`{"id":"nine"}`), expectedKind: JSONErrorType},
+	{name: "unknown field", contentType: "application/json", disallow: true, body: []byte(`{"id":10,"extra":true}`), expectedKind: JSONErrorUnknownField},
+}
+
+func TestJSONClientDecoding(test *testing.T) {
+	for _, entry := range clientDecodingTests {
+		server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			responseWriter.Header().Set("Content-Type", entry.contentType)
+			if entry.encoding != "" {
+				responseWriter.Header().Set("Content-Encoding", entry.encoding)
+			}
+			_, _ = responseWriter.Write(entry.body)
+		}))
+
+		client, _ := NewJSONClient(server.URL)
+		client.MaxResponseSize = 64
+		client.DisallowUnknownFields = entry.disallow
+		client.AllowAnyContentType = entry.anyType
+
+		var reply struct {
+			ID int `json:"id"`
+		}
+		_, err := client.Get(context.Background(), "/", &reply)
+		server.Close()
+
+		if entry.expectedKind == "" {
+			if err != nil || reply.ID != entry.expectedValue {
+				test.Errorf("%s: expected id %d but got %d, %v", entry.name, entry.expectedValue, reply.ID, err)
+			}
+			continue
+		}
+
+		var responseError *ResponseError
+		var jsonError *JSONError
+		if !errors.As(err, &responseError) || !errors.As(err, &jsonError) || jsonError.Kind != entry.expectedKind {
+			test.Errorf("%s: expected a %s error but got %v", entry.name, entry.expectedKind, err)
+			continue
+		}
+		if errorStatus(err) != http.StatusBadGateway {
+			test.Errorf("%s: expected ErrorJSON to send 502 but it would send %d", entry.name, errorStatus(err))
+		}
+	}
+}
+
+func TestResponseErrorMasked(test *testing.T) {
+	responseError := &ResponseError{Method: "GET", URL: "http://internal.example/secret", RemoteStatus: 200, Err: errors.New("invalid character")}
+
+	testTools := Tools{}
+	responseRecorder := httptest.NewRecorder()
+	_ = testTools.ErrorJSON(responseRecorder, responseError)
+	if responseRecorder.Code != http.StatusBadGateway {
+		test.Errorf("expected 502, got %d", responseRecorder.Code)
+	}
+	if body := responseRecorder.Body.String(); strings.Contains(body, "internal.example") || !strings.Contains(body, genericErrorMessage) {
+		test.Errorf("expected remote details to be masked, got %s", body)
+	}
+}
+
+func TestTools_ReadRemoteJSON(test *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		_, _ = responseWriter.Write([]byte(`{"id":1,"name":"one"}`))
+	}))
+	defer server.Close()
+	remoteURI, _ := url.Parse(server.URL)
+
+	testTools := Tools{AllowUnknownFields: true}
+	response, _, err := testTools.PostJSONToRemote(*remoteURI, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	var reply struct {
+		ID int `json:"id"`
+	}
+	if err := testTools.ReadRemoteJSON(response, &reply); err != nil || reply.ID != 1 {
+		test.Errorf("unexpected reply %+v, %v", reply, err)
+	}
+
+	testTools = Tools{MaxRemoteResponseSize: 8}
+	_, _, err = testTools.PostJSONToRemote(*remoteURI, nil)
+	var jsonError *JSONError
+	if !errors.As(err, &jsonError) || jsonError.Kind != JSONErrorTooLarge {
+		test.Errorf("expected the response to be too large but got %v", err)
+	}
+}
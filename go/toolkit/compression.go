@@ -0,0 +1,278 @@
+package toolkit
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precompressedEncodings lists the sibling file extensions DownloadStaticFile looks for,
+// in order of server preference
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{encoding: "br", extension: ".br"},
+	{encoding: "gzip", extension: ".gz"},
+}
+
+// onTheFlyEncodings lists the encodings the toolkit can produce itself, in order of server preference
+var onTheFlyEncodings = []string{"gzip", "deflate"}
+
+// negotiateEncoding picks the best content coding from offered given an Accept-Encoding header value
+// returns an empty string when the identity encoding should be used
+// ties between equally weighted codings are broken by the order of offered
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	if acceptEncoding == "" || len(offered) == 0 {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, quality := parseQualityValue(part)
+		if coding == "" {
+			continue
+		}
+		if coding == "*" {
+			wildcard = quality
+			continue
+		}
+		weights[coding] = quality
+	}
+
+	best, bestWeight := "", 0.0
+	for _, encoding := range offered {
+		weight, ok := weights[encoding]
+		if !ok {
+			if wildcard < 0 {
+				continue
+			}
+			weight = wildcard
+		}
+		if weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
+
+// parseQualityValue splits an element of an Accept style header into its lower cased value and q weight
+func parseQualityValue(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	value := strings.ToLower(strings.TrimSpace(fields[0]))
+	quality := 1.0
+	for _, param := range fields[1:] {
+		key, rawValue, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(rawValue), 64)
+		if err != nil {
+			continue
+		}
+		quality = parsed
+	}
+	return value, quality
+}
+
+// fallbackMIMETypes are used for extensions missing from Go's built in table when the host has no
+// mime.types file, so the content type, and whether it is compressed, does not depend on the host
+var fallbackMIMETypes = map[string]string{
+	".csv":  "text/csv; charset=utf-8",
+	".tsv":  "text/tab-separated-values; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".ics":  "text/calendar; charset=utf-8",
+}
+
+// typeByExtension is mime.TypeByExtension, falling back to fallbackMIMETypes
+func typeByExtension(extension string) string {
+	if contentType := mime.TypeByExtension(extension); contentType != "" {
+		return contentType
+	}
+	return fallbackMIMETypes[strings.ToLower(extension)]
+}
+
+// staticContentType is the content type of the file at filePath, from its extension or else its content
+func staticContentType(filePath string) string {
+	if contentType := typeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return http.DetectContentType(head[:n])
+}
+
+// isCompressible reports whether content of the given MIME type benefits from compression
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson",
+		"application/ecmascript", "application/wasm", "application/x-javascript":
+		return true
+	}
+	return false
+}
+
+// newCompressionWriter wraps writer with an encoder for the given content coding
+func newCompressionWriter(writer io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(writer), nil
+	case "deflate":
+		// HTTP deflate is the zlib format (RFC 9110 section 8.4.1.2), not raw DEFLATE
+		return zlib.NewWriter(writer), nil
+	default:
+		return nil, errors.New("unsupported content encoding " + encoding)
+	}
+}
+
+// ContentDecoderFunc wraps a request body sent with a Content-Encoding so it can be read decompressed
+type ContentDecoderFunc func(io.Reader) (io.ReadCloser, error)
+
+// defaultContentDecoders are the request Content-Encodings ReadJSON understands without configuration
+var defaultContentDecoders = map[string]ContentDecoderFunc{
+	"gzip": func(reader io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(reader)
+	},
+	"x-gzip": func(reader io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(reader)
+	},
+	// HTTP deflate is the zlib format (RFC 9110 section 8.4.1.2), not raw DEFLATE
+	"deflate": func(reader io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(reader)
+	},
+}
+
+// errDecompressedTooLarge signals that a body grew beyond its limit while being decompressed
+var errDecompressedTooLarge = errors.New("decompressed body too large")
+
+// decompressionError wraps failures of a content decoder, such as a bad gzip checksum
+type decompressionError struct {
+	err error
+}
+
+func (decompressError *decompressionError) Error() string {
+	return "content decoding failed: " + decompressError.err.Error()
+}
+
+func (decompressError *decompressionError) Unwrap() error {
+	return decompressError.err
+}
+
+// decompressBody undoes each coding listed in contentEncoding, last applied first
+// the decompressed stream is cut off with errDecompressedTooLarge once it exceeds limit bytes
+// decoders supplements and overrides defaultContentDecoders
+func decompressBody(body io.Reader, contentEncoding string, decoders map[string]ContentDecoderFunc, limit int64) (io.Reader, func(), error) {
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 {
+		return body, func() {}, nil
+	}
+
+	var closers []io.Closer
+	closeAll := func() {
+		for idx := len(closers) - 1; idx >= 0; idx-- {
+			_ = closers[idx].Close()
+		}
+	}
+
+	reader := body
+	for idx := len(codings) - 1; idx >= 0; idx-- {
+		decoder, ok := decoders[codings[idx]]
+		if !ok {
+			decoder, ok = defaultContentDecoders[codings[idx]]
+		}
+		if !ok {
+			closeAll()
+			return nil, func() {}, &JSONError{
+				Kind:    JSONErrorUnsupportedEncoding,
+				Message: fmt.Sprintf("Content-Encoding %s is not supported", codings[idx]),
+				Actual:  codings[idx],
+			}
+		}
+
+		decoded, err := decoder(reader)
+		if err != nil {
+			closeAll()
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return nil, func() {}, tooLargeError(err, limit)
+			}
+			return nil, func() {}, &JSONError{Kind: JSONErrorCorruptEncoding, Message: "body could not be decompressed", Err: err}
+		}
+		closers = append(closers, decoded)
+		reader = &decompressionErrorReader{reader: decoded}
+	}
+
+	return &decompressionLimitReader{reader: reader, limit: limit}, closeAll, nil
+}
+
+// decompressionErrorReader marks errors raised by a content decoder so they can be told apart
+// from errors raised by the underlying body
+type decompressionErrorReader struct {
+	reader io.Reader
+}
+
+func (errorReader *decompressionErrorReader) Read(p []byte) (int, error) {
+	n, err := errorReader.reader.Read(p)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	var maxBytesError *http.MaxBytesError
+	var decompressError *decompressionError
+	if errors.As(err, &maxBytesError) || errors.As(err, &decompressError) {
+		return n, err
+	}
+	return n, &decompressionError{err: err}
+}
+
+// decompressionLimitReader fails with errDecompressedTooLarge once more than limit bytes are read
+type decompressionLimitReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (limitReader *decompressionLimitReader) Read(p []byte) (int, error) {
+	n, err := limitReader.reader.Read(p)
+	limitReader.read += int64(n)
+	if limitReader.read > limitReader.limit {
+		return n - int(limitReader.read-limitReader.limit), errDecompressedTooLarge
+	}
+	return n, err
+}
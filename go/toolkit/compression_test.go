@@ -0,0 +1,284 @@
+package toolkit
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var negotiateEncodingTests = []struct {
+	name           string
+	acceptEncoding string
+	offered        []string
+	expected       string
+}{
+	{name: "no header", acceptEncoding: "", offered: []string{"br", "gzip"}, expected: ""},
+	{name: "server preference on tie", acceptEncoding: "gzip, br", offered: []string{"br", "gzip"}, expected: "br"},
+	{name: "client weights", acceptEncoding: "br;q=0.5, gzip", offered: []string{"br", "gzip"}, expected: "gzip"},
+	{name: "refused encoding", acceptEncoding: "gzip;q=0", offered: []string{"gzip"}, expected: ""},
+	{name: "wildcard", acceptEncoding: "*", offered: []string{"gzip"}, expected: "gzip"},
+	{name: "wildcard with exclusion", acceptEncoding: "br;q=0, *;q=0.5", offered: []string{"br", "gzip"}, expected: "gzip"},
+	{name: "nothing offered", acceptEncoding: "gzip", offered: nil, expected: ""},
+	{name: "unknown encoding", acceptEncoding: "compress", offered: []string{"gzip"}, expected: ""},
+}
+
+func TestTools_negotiateEncoding(test *testing.T) {
+	for _, entry := range negotiateEncodingTests {
+		encoding := negotiateEncoding(entry.acceptEncoding, entry.offered)
+		if encoding != entry.expected {
+			test.Errorf("%s: expected %q but got %q", entry.name, entry.expected, encoding)
+		}
+	}
+}
+
+func writeCompressedTestFiles(test *testing.T) (string, string) {
+	directory := test.TempDir()
+	content := strings.Repeat("id,name,amount\n1,widget,42\n", 500)
+
+	err := os.WriteFile(filepath.Join(directory, "export.csv"), []byte(content), 0644)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, _ = gzipWriter.Write([]byte(content))
+	_ = gzipWriter.Close()
+	err = os.WriteFile(filepath.Join(directory, "export.csv.gz"), compressed.Bytes(), 0644)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	return directory, content
+}
+
+var downloadCompressedTests = []struct {
+	name             string
+	acceptEncoding   string
+	compressOnTheFly bool
+	removeSibling    bool
+	expectedEncoding string
+}{
+	{name: "precompressed gzip", acceptEncoding: "gzip, deflate", expectedEncoding: "gzip"},
+	{name: "identity when not accepted", acceptEncoding: "", expectedEncoding: ""},
+	{name: "identity when refused", acceptEncoding: "gzip;q=0", expectedEncoding: ""},
+	{name: "on the fly deflate", acceptEncoding: "deflate", compressOnTheFly: true, expectedEncoding: "deflate"},
+	{name: "on the fly gzip", acceptEncoding: "gzip", compressOnTheFly: true, removeSibling: true, expectedEncoding: "gzip"},
+	{name: "on the fly disabled", acceptEncoding: "deflate", compressOnTheFly: false, expectedEncoding: ""},
+}
+
+func TestTools_DownloadStaticFileCompressed(test *testing.T) {
+	for _, entry := range downloadCompressedTests {
+		directory, content := writeCompressedTestFiles(test)
+		if entry.removeSibling {
+			_ = os.Remove(filepath.Join(directory, "export.csv.gz"))
+		}
+
+		testTools := Tools{CompressStaticFiles: entry.compressOnTheFly}
+		request := httptest.NewRequest("GET", "/", nil)
+		if entry.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", entry.acceptEncoding)
+		}
+		responseRecorder := httptest.NewRecorder()
+
+		testTools.DownloadStaticFile(responseRecorder, request, directory, "export.csv", "export.csv")
+		response := responseRecorder.Result()
+
+		if response.StatusCode != http.StatusOK {
+			test.Errorf("%s: wrong status code %d", entry.name, response.StatusCode)
+			continue
+		}
+		if encoding := response.Header.Get("Content-Encoding"); encoding != entry.expectedEncoding {
+			test.Errorf("%s: expected Content-Encoding %q but got %q", entry.name, entry.expectedEncoding, encoding)
+		}
+		if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/csv") {
+			test.Errorf("%s: wrong content type %s", entry.name, response.Header.Get("Content-Type"))
+		}
+		if response.Header.Get("Vary") != "Accept-Encoding" && (entry.expectedEncoding != "" || entry.compressOnTheFly) {
+			test.Errorf("%s: expected Vary: Accept-Encoding", entry.name)
+		}
+
+		var body io.Reader = response.Body
+		switch entry.expectedEncoding {
+		case "gzip":
+			body, _ = gzip.NewReader(response.Body)
+		case "deflate":
+			body, _ = zlib.NewReader(response.Body)
+		}
+		decoded, err := io.ReadAll(body)
+		if err != nil {
+			test.Errorf("%s: failed to decode body: %v", entry.name, err)
+		}
+		if string(decoded) != content {
+			test.Errorf("%s: decoded body does not match the original file", entry.name)
+		}
+	}
+}
+
+func TestTools_DownloadStaticFileCompressedNotModified(test *testing.T) {
+	directory, _ := writeCompressedTestFiles(test)
+	_ = os.Remove(filepath.Join(directory, "export.csv.gz"))
+	testTools := Tools{CompressStaticFiles: true}
+
+	tests := []struct {
+		name     string
+		since    time.Time
+		expected int
+	}{
+		{name: "unchanged", since: time.Now().Add(time.Hour), expected: http.StatusNotModified},
+		{name: "changed", since: time.Now().Add(-time.Hour), expected: http.StatusOK},
+	}
+
+	for _, entry := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		request.Header.Set("If-Modified-Since", entry.since.UTC().Format(http.TimeFormat))
+		responseRecorder := httptest.NewRecorder()
+
+		testTools.DownloadStaticFile(responseRecorder, request, directory, "export.csv", "export.csv")
+		if responseRecorder.Code != entry.expected {
+			test.Errorf("%s: expected status %d but got %d", entry.name, entry.expected, responseRecorder.Code)
+		}
+		if entry.expected == http.StatusNotModified && (responseRecorder.Body.Len() != 0 || responseRecorder.Header().Get("Content-Encoding") != "") {
+			test.Errorf("%s: expected an empty 304 but got %d bytes, encoding %q", entry.name, responseRecorder.Body.Len(), responseRecorder.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestStaticContentType(test *testing.T) {
+	directory, _ := writeCompressedTestFiles(test)
+	if contentType := staticContentType(filepath.Join(directory, "export.csv")); !strings.HasPrefix(contentType, "text/csv") {
+		test.Errorf("expected text/csv, got %s", contentType)
+	}
+
+	// without a known extension the content is sniffed
+	if err := os.WriteFile(filepath.Join(directory, "notes"), []byte("plain text notes"), 0644); err != nil {
+		test.Fatal(err)
+	}
+	if contentType := staticContentType(filepath.Join(directory, "notes")); contentType != "text/plain; charset=utf-8" {
+		test.Errorf("expected sniffed text/plain, got %s", contentType)
+	}
+}
+
+func compressForTest(test *testing.T, encoding string, content []byte) []byte {
+	var compressed bytes.Buffer
+	var compressor io.WriteCloser
+	var err error
+	if encoding == "deflate" {
+		// as standard clients send it
+		compressor = zlib.NewWriter(&compressed)
+	} else if compressor, err = newCompressionWriter(&compressed, encoding); err != nil {
+		test.Fatal(err)
+	}
+	_, _ = compressor.Write(content)
+	_ = compressor.Close()
+	return compressed.Bytes()
+}
+
+var decompressTests = []struct {
+	name            string
+	contentEncoding string
+	body            func(test *testing.T) []byte
+	maxSize         int
+	expectedKind    JSONErrorKind
+}{
+	{name: "gzip", contentEncoding: "gzip", maxSize: 1024, body: func(test *testing.T) []byte {
+		return compressForTest(test, "gzip", []byte(`{"foo":"bar"}`))
+	}},
+	{name: "deflate", contentEncoding: "deflate", maxSize: 1024, body: func(test *testing.T) []byte {
+		return compressForTest(test, "deflate", []byte(`{"foo":"bar"}`))
+	}},
+	{name: "identity", contentEncoding: "identity", maxSize: 1024, body: func(test *testing.T) []byte {
+		return []byte(`{"foo":"bar"}`)
+	}},
+	{name: "layered", contentEncoding: "deflate, gzip", maxSize: 1024, body: func(test *testing.T) []byte {
+		return compressForTest(test, "gzip", compressForTest(test, "deflate", []byte(`{"foo":"bar"}`)))
+	}},
+	{name: "compression bomb", contentEncoding: "gzip", maxSize: 1024, expectedKind: JSONErrorDecompressedTooLarge, body: func(test *testing.T) []byte {
+		return compressForTest(test, "gzip", []byte(`{"foo":"`+strings.Repeat("a", 1024*1024)+`"}`))
+	}},
+	{name: "corrupt gzip", contentEncoding: "gzip", maxSize: 1024, expectedKind: JSONErrorCorruptEncoding, body: func(test *testing.T) []byte {
+		return []byte(`{"foo":"bar"}`)
+	}},
+	{name: "raw deflate", contentEncoding: "deflate", maxSize: 1024, expectedKind: JSONErrorCorruptEncoding, body: func(test *testing.T) []byte {
+		var compressed bytes.Buffer
+		compressor, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+		_, _ = compressor.Write([]byte(`{"foo":"bar"}`))
+		_ = compressor.Close()
+		return compressed.Bytes()
+	}},
+	{name: "truncated gzip", contentEncoding: "gzip", maxSize: 1024, expectedKind: JSONErrorCorruptEncoding, body: func(test *testing.T) []byte {
+		compressed := compressForTest(test, "gzip", []byte(`{"foo":"bar"}`))
+		return compressed[:len(compressed)-10]
+	}},
+	{name: "unsupported encoding", contentEncoding: "compress", maxSize: 1024, expectedKind: JSONErrorUnsupportedEncoding, body: func(test *testing.T) []byte {
+		return []byte(`{"foo":"bar"}`)
+	}},
+}
+
+func TestTools_ReadJSONDecompression(test *testing.T) {
+	for _, entry := range decompressTests {
+		testTools := Tools{MaxJSONSize: entry.maxSize}
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		request := httptest.NewRequest("POST", "/", bytes.NewReader(entry.body(test)))
+		request.Header.Set("Content-Encoding", entry.contentEncoding)
+		err := testTools.ReadJSON(httptest.NewRecorder(), request, &decodedJSON)
+
+		if entry.expectedKind == "" {
+			if err != nil {
+				test.Errorf("%s: error not expected, but one received: %s", entry.name, err.Error())
+			} else if decodedJSON.Foo != "bar" {
+				test.Errorf("%s: body was not decoded", entry.name)
+			}
+			continue
+		}
+
+		var jsonError *JSONError
+		if !errors.As(err, &jsonError) || jsonError.Kind != entry.expectedKind {
+			test.Errorf("%s: expected a %s error but got %v", entry.name, entry.expectedKind, err)
+		}
+	}
+}
+
+func TestTools_ReadJSONCustomDecoder(test *testing.T) {
+	testTools := Tools{
+		ContentDecoders: map[string]ContentDecoderFunc{
+			"reverse": func(reader io.Reader) (io.ReadCloser, error) {
+				content, err := io.ReadAll(reader)
+				if err != nil {
+					return nil, err
+				}
+				for i, j := 0, len(content)-1; i < j; i, j = i+1, j-1 {
+					content[i], content[j] = content[j], content[i]
+				}
+				return io.NopCloser(bytes.NewReader(content)), nil
+			},
+		},
+	}
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	request := httptest.NewRequest("POST", "/", strings.NewReader(`}"rab":"oof"{`))
+	request.Header.Set("Content-Encoding", "reverse")
+	err := testTools.ReadJSON(httptest.NewRecorder(), request, &decodedJSON)
+	if err != nil {
+		test.Error(err)
+	}
+	if decodedJSON.Foo != "bar" {
+		test.Errorf("expected foo to be bar but got %q", decodedJSON.Foo)
+	}
+}
@@ -0,0 +1,103 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Response is a typed version of JSONResponse, so a handler and its Go clients share the shape of Data
+// it marshals to the same members as JSONResponse, plus meta and links for paged results
+type Response[T any] struct {
+	Error     bool      `json:"error"`
+	Message   string    `json:"message"`
+	Code      string    `json:"code,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Data      T         `json:"data"`
+	Meta      *PageMeta `json:"meta,omitempty"`
+	Links     *Links    `json:"links,omitempty"`
+}
+
+// PageMeta describes the page of results a Response holds
+// use Page and PerPage for offset pagination, or NextCursor for cursor pagination
+type PageMeta struct {
+	Page       int    `json:"page,omitempty"`
+	PerPage    int    `json:"per_page,omitempty"`
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Links holds URLs related to a Response, such as neighbouring pages
+type Links struct {
+	Self  string `json:"self,omitempty"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// NewResponse wraps data in a successful Response
+func NewResponse[T any](data T, message ...string) Response[T] {
+	response := Response[T]{Data: data}
+	if len(message) > 0 {
+		response.Message = message[0]
+	}
+	return response
+}
+
+// NewPage wraps one page of items in a successful Response with its pagination metadata
+// links may be nil when the client builds its own URLs
+func NewPage[T any](items []T, meta PageMeta, links *Links) Response[[]T] {
+	if items == nil {
+		// an empty page is sent as [] rather than null
+		items = []T{}
+	}
+	return Response[[]T]{Data: items, Meta: &meta, Links: links}
+}
+
+// ReadJSONAs reads the body of a request into a new T with ReadJSON, returning it by value
+// all of ReadJSON's limits, decoding errors and validation apply
+func ReadJSONAs[T any](tools *Tools, responseWriter http.ResponseWriter, request *http.Request) (T, error) {
+	var data T
+	if err := tools.ReadJSON(responseWriter, request, &data); err != nil {
+		var zero T
+		return zero, err
+	}
+	return data, nil
+}
+
+// WriteJSONAs wraps data in a Response and sends it with WriteJSON
+func WriteJSONAs[T any](tools *Tools, responseWriter http.ResponseWriter, status int, data T, headers ...http.Header) error {
+	return tools.WriteJSON(responseWriter, status, NewResponse(data), headers...)
+}
+
+// DecodeResponse reads a Response[T] from the body of an HTTP response, such as one returned by
+// PostJSONToRemote, for Go clients of handlers which send Response[T]
+// an envelope with its error member set is returned along with an error holding its message;
+// its data, such as field errors, is ignored, as it need not have the shape of T
+func DecodeResponse[T any](body io.Reader) (Response[T], error) {
+	// the error members are read before data, which is only decoded into T on success
+	var envelope Response[json.RawMessage]
+	if err := json.NewDecoder(body).Decode(&envelope); err != nil {
+		return Response[T]{}, err
+	}
+
+	response := Response[T]{
+		Error:     envelope.Error,
+		Message:   envelope.Message,
+		Code:      envelope.Code,
+		RequestID: envelope.RequestID,
+		Meta:      envelope.Meta,
+		Links:     envelope.Links,
+	}
+	if response.Error {
+		return response, fmt.Errorf("remote error: %s", response.Message)
+	}
+	if len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, &response.Data); err != nil {
+			return response, err
+		}
+	}
+	return response, nil
+}
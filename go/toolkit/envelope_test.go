@@ -0,0 +1,78 @@
+package toolkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type envelopeItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name" validate:"required"`
+}
+
+func TestReadJSONAs(test *testing.T) {
+	testTools := Tools{ValidateJSON: true}
+
+	request := httptest.NewRequest("POST", "/", strings.NewReader(`{"id":7,"name":"seven"}`))
+	item, err := ReadJSONAs[envelopeItem](&testTools, httptest.NewRecorder(), request)
+	if err != nil || item.ID != 7 || item.Name != "seven" {
+		test.Errorf("unexpected result %+v, %v", item, err)
+	}
+
+	request = httptest.NewRequest("POST", "/", strings.NewReader(`{"id":7}`))
+	item, err = ReadJSONAs[envelopeItem](&testTools, httptest.NewRecorder(), request)
+	if err == nil || item.ID != 0 {
+		test.Errorf("expected a validation error and the zero value but got %+v, %v", item, err)
+	}
+}
+
+func TestNewPage(test *testing.T) {
+	var testTools Tools
+	responseRecorder := httptest.NewRecorder()
+	page := NewPage([]envelopeItem{{ID: 1, Name: "one"}, {ID: 2, Name: "two"}}, PageMeta{Page: 1, PerPage: 2, Total: 5}, &Links{Next: "/items?page=2"})
+	if err := testTools.WriteJSON(responseRecorder, http.StatusOK, page); err != nil {
+		test.Fatal(err)
+	}
+
+	expected := `{"error":false,"message":"","data":[{"id":1,"name":"one"},{"id":2,"name":"two"}],"meta":{"page":1,"per_page":2,"total":5},"links":{"next":"/items?page=2"}}`
+	if responseRecorder.Body.String() != expected {
+		test.Errorf("expected %s but got %s", expected, responseRecorder.Body.String())
+	}
+
+	decoded, err := DecodeResponse[[]envelopeItem](responseRecorder.Body)
+	if err != nil || len(decoded.Data) != 2 || decoded.Data[1].Name != "two" || decoded.Meta.Total != 5 || decoded.Links.Next != "/items?page=2" {
+		test.Errorf("unexpected decoded response %+v, %v", decoded, err)
+	}
+
+	empty := NewPage[envelopeItem](nil, PageMeta{NextCursor: "abc"}, nil)
+	responseRecorder = httptest.NewRecorder()
+	_ = testTools.WriteJSON(responseRecorder, http.StatusOK, empty)
+	if !strings.Contains(responseRecorder.Body.String(), `"data":[]`) {
+		test.Errorf("expected an empty array but got %s", responseRecorder.Body.String())
+	}
+}
+
+func TestDecodeResponseError(test *testing.T) {
+	var testTools Tools
+	responseRecorder := httptest.NewRecorder()
+	_ = testTools.ErrorJSON(responseRecorder, &JSONError{Kind: JSONErrorSyntax, Message: "bad json"})
+
+	_, err := DecodeResponse[envelopeItem](responseRecorder.Body)
+	if err == nil || !strings.Contains(err.Error(), "bad json") {
+		test.Errorf("expected the remote error but got %v", err)
+	}
+}
+
+func TestDecodeResponseErrorData(test *testing.T) {
+	var testTools Tools
+	responseRecorder := httptest.NewRecorder()
+	_ = testTools.ErrorJSON(responseRecorder, ValidationErrors{{Field: "name", Rule: "required", Message: "name is required"}})
+
+	// the field errors in data do not fit envelopeItem, but the remote error is still returned
+	decoded, err := DecodeResponse[envelopeItem](responseRecorder.Body)
+	if err == nil || !strings.Contains(err.Error(), "remote error") || !decoded.Error {
+		test.Errorf("expected the remote error but got %+v, %v", decoded, err)
+	}
+}
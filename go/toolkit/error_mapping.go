@@ -0,0 +1,113 @@
+package toolkit
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// genericErrorMessage is what clients see for errors that are neither registered nor toolkit errors
+const genericErrorMessage = "internal server error"
+
+// ErrorMapping describes how ErrorJSON and ProblemJSON present a registered error to clients
+type ErrorMapping struct {
+	// Status is the HTTP status code; zero keeps the status ErrorJSON would otherwise use
+	Status int
+	// Code is a stable, machine readable error code sent alongside the message
+	Code string
+	// Message replaces the error's own text; leave empty to send err.Error()
+	Message string
+}
+
+// errorRule pairs a matcher with the mapping to use when it matches
+type errorRule struct {
+	matches func(error) bool
+	mapping ErrorMapping
+}
+
+// internalError is implemented by toolkit errors which have a status but whose text describes
+// internals, such as the URL of another service, so they are masked like unknown errors
+type internalError interface {
+	internalError()
+}
+
+// resolvedError is what is sent to the client for an error
+type resolvedError struct {
+	status  int
+	message string
+	code    string
+	masked  bool
+}
+
+// RegisterError maps a sentinel error, matched with errors.Is, to a status, code and message
+// register errors while setting up Tools, before it is used to handle requests
+func (tools *Tools) RegisterError(target error, mapping ErrorMapping) {
+	tools.errorRules = append(tools.errorRules, errorRule{
+		matches: func(err error) bool {
+			return errors.Is(err, target)
+		},
+		mapping: mapping,
+	})
+}
+
+// RegisterErrorType maps every error of the same type as target, matched with errors.As,
+// to a status, code and message
+// target is any value of the type, for example (*os.PathError)(nil) or &os.PathError{}
+// register errors while setting up Tools, before it is used to handle requests
+// an error is returned, and nothing registered, when target is nil
+func (tools *Tools) RegisterErrorType(target error, mapping ErrorMapping) error {
+	if target == nil {
+		return errors.New("RegisterErrorType needs a value of the error type, not nil")
+	}
+	targetType := reflect.TypeOf(target)
+	tools.errorRules = append(tools.errorRules, errorRule{
+		matches: func(err error) bool {
+			return errors.As(err, reflect.New(targetType).Interface())
+		},
+		mapping: mapping,
+	})
+	return nil
+}
+
+// resolveError decides the status, message and code sent for err
+// an explicit status always wins; after that registered mappings are checked in the order they
+// were registered, then errors with their own StatusCode (the toolkit's typed errors)
+// anything else becomes a 500 with a generic message, so internal details are not leaked, unless
+// the caller gave a 4xx status, which is taken to mean the message is meant for the client, or
+// ExposeUnknownErrors is set; toolkit errors whose text describes internals are masked the same way,
+// whatever status the caller gave, unless ExposeUnknownErrors is set
+func (tools *Tools) resolveError(err error, status ...int) resolvedError {
+	for _, rule := range tools.errorRules {
+		if !rule.matches(err) {
+			continue
+		}
+
+		resolved := resolvedError{status: rule.mapping.Status, message: rule.mapping.Message, code: rule.mapping.Code}
+		if resolved.message == "" {
+			resolved.message = err.Error()
+		}
+		if len(status) > 0 || resolved.status == 0 {
+			resolved.status = errorStatus(err, status...)
+		}
+		return resolved
+	}
+
+	var internal internalError
+	isInternal := errors.As(err, &internal)
+	var coder interface{ StatusCode() int }
+	if errors.As(err, &coder) && !isInternal {
+		return resolvedError{status: errorStatus(err, status...), message: err.Error()}
+	}
+	if tools.ExposeUnknownErrors || (!isInternal && len(status) > 0 && status[0] < http.StatusInternalServerError) {
+		return resolvedError{status: errorStatus(err, status...), message: err.Error()}
+	}
+
+	resolved := resolvedError{status: http.StatusInternalServerError, message: genericErrorMessage, masked: true}
+	switch {
+	case len(status) > 0 && status[0] >= http.StatusInternalServerError:
+		resolved.status = status[0]
+	case coder != nil:
+		resolved.status = coder.StatusCode()
+	}
+	return resolved
+}
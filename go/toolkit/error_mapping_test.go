@@ -0,0 +1,110 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var errNotFound = errors.New("record not found")
+
+type quotaError struct {
+	Remaining int
+}
+
+func (quota *quotaError) Error() string {
+	return fmt.Sprintf("quota exceeded, %d remaining", quota.Remaining)
+}
+
+var errorMappingTests = []struct {
+	name            string
+	expose          bool
+	err             error
+	status          []int
+	expectedStatus  int
+	expectedMessage string
+	expectedCode    string
+}{
+	{name: "sentinel", err: errNotFound, expectedStatus: http.StatusNotFound, expectedMessage: "record not found", expectedCode: "not_found"},
+	{name: "wrapped sentinel", err: fmt.Errorf("loading user 12: %w", errNotFound), expectedStatus: http.StatusNotFound, expectedMessage: "loading user 12: record not found", expectedCode: "not_found"},
+	{name: "error type", err: fmt.Errorf("sending: %w", &quotaError{Remaining: 0}), expectedStatus: http.StatusTooManyRequests, expectedMessage: "slow down", expectedCode: "quota"},
+	{name: "explicit status wins", err: errNotFound, status: []int{http.StatusGone}, expectedStatus: http.StatusGone, expectedMessage: "record not found", expectedCode: "not_found"},
+	{name: "unknown error", err: errors.New("some error"), expectedStatus: http.StatusInternalServerError, expectedMessage: "internal server error"},
+	{name: "unknown error masked", err: &os.PathError{Op: "open", Path: "/srv/secret/config.yaml", Err: os.ErrNotExist}, expectedStatus: http.StatusInternalServerError, expectedMessage: "internal server error"},
+	{name: "masked with explicit status", err: errors.New("some error"), status: []int{http.StatusServiceUnavailable}, expectedStatus: http.StatusServiceUnavailable, expectedMessage: "internal server error"},
+	{name: "explicit client status", err: errors.New("email is taken"), status: []int{http.StatusConflict}, expectedStatus: http.StatusConflict, expectedMessage: "email is taken"},
+	{name: "unknown error exposed", expose: true, err: errors.New("some error"), expectedStatus: http.StatusBadRequest, expectedMessage: "some error"},
+	{name: "toolkit error not masked", err: &JSONError{Kind: JSONErrorTooLarge, Message: "body too large", Limit: 8}, expectedStatus: http.StatusRequestEntityTooLarge, expectedMessage: "body too large"},
+}
+
+func newMappedTools(expose bool) Tools {
+	testTools := Tools{ExposeUnknownErrors: expose}
+	testTools.RegisterError(errNotFound, ErrorMapping{Status: http.StatusNotFound, Code: "not_found"})
+	_ = testTools.RegisterErrorType(&quotaError{}, ErrorMapping{Status: http.StatusTooManyRequests, Code: "quota", Message: "slow down"})
+	return testTools
+}
+
+func TestTools_ErrorMapping(test *testing.T) {
+	for _, entry := range errorMappingTests {
+		testTools := newMappedTools(entry.expose)
+
+		responseRecorder := httptest.NewRecorder()
+		if err := testTools.ErrorJSON(responseRecorder, entry.err, entry.status...); err != nil {
+			test.Fatal(err)
+		}
+
+		var payload JSONResponse
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&payload); err != nil {
+			test.Fatalf("%s: %v", entry.name, err)
+		}
+		if responseRecorder.Code != entry.expectedStatus {
+			test.Errorf("%s: expected status %d but got %d", entry.name, entry.expectedStatus, responseRecorder.Code)
+		}
+		if payload.Message != entry.expectedMessage {
+			test.Errorf("%s: expected message %q but got %q", entry.name, entry.expectedMessage, payload.Message)
+		}
+		if payload.Code != entry.expectedCode {
+			test.Errorf("%s: expected code %q but got %q", entry.name, entry.expectedCode, payload.Code)
+		}
+		if strings.Contains(responseRecorder.Body.String(), "/srv/secret") {
+			test.Errorf("%s: response leaks the file path: %s", entry.name, responseRecorder.Body.String())
+		}
+	}
+}
+
+func TestTools_ErrorMappingProblemJSON(test *testing.T) {
+	testTools := newMappedTools(false)
+	testTools.UseProblemJSON = true
+
+	responseRecorder := httptest.NewRecorder()
+	_ = testTools.ErrorJSON(responseRecorder, &quotaError{Remaining: 0})
+
+	var members map[string]interface{}
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&members); err != nil {
+		test.Fatal(err)
+	}
+	if responseRecorder.Code != http.StatusTooManyRequests || members["detail"] != "slow down" || members["code"] != "quota" {
+		test.Errorf("unexpected problem %d %v", responseRecorder.Code, members)
+	}
+
+	responseRecorder = httptest.NewRecorder()
+	_ = testTools.ErrorJSON(responseRecorder, &os.PathError{Op: "open", Path: "/srv/secret/config.yaml", Err: os.ErrNotExist})
+	if responseRecorder.Code != http.StatusInternalServerError || strings.Contains(responseRecorder.Body.String(), "/srv/secret") {
+		test.Errorf("expected a masked 500 but got %d %s", responseRecorder.Code, responseRecorder.Body.String())
+	}
+}
+
+func TestTools_RegisterErrorTypeNil(test *testing.T) {
+	var testTools Tools
+	if err := testTools.RegisterErrorType(nil, ErrorMapping{Status: http.StatusNotFound}); err == nil {
+		test.Error("expected an error registering a nil error type")
+	}
+	if len(testTools.errorRules) != 0 {
+		test.Error("expected nothing to be registered")
+	}
+}
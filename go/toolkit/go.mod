@@ -1,6 +1,6 @@
 module github.com/awkwardjake/public/go/toolkit
 
-go 1.19
+go 1.21
 
 require github.com/fatih/color v1.15.0
 
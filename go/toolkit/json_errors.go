@@ -0,0 +1,247 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSONErrorKind classifies why a JSON body could not be read
+type JSONErrorKind string
+
+const (
+	JSONErrorSyntax               JSONErrorKind = "syntax"
+	JSONErrorTruncated            JSONErrorKind = "truncated"
+	JSONErrorType                 JSONErrorKind = "type"
+	JSONErrorEmptyBody            JSONErrorKind = "empty_body"
+	JSONErrorUnknownField         JSONErrorKind = "unknown_field"
+	JSONErrorTooLarge             JSONErrorKind = "too_large"
+	JSONErrorDecompressedTooLarge JSONErrorKind = "decompressed_too_large"
+	JSONErrorMultipleValues       JSONErrorKind = "multiple_values"
+	JSONErrorTooManyItems         JSONErrorKind = "too_many_items"
+	JSONErrorInvalidTarget        JSONErrorKind = "invalid_target"
+	JSONErrorUnsupportedMediaType JSONErrorKind = "unsupported_media_type"
+	JSONErrorUnsupportedEncoding  JSONErrorKind = "unsupported_encoding"
+	JSONErrorCorruptEncoding      JSONErrorKind = "corrupt_encoding"
+)
+
+// JSONError is returned by ReadJSON when a body cannot be decoded
+// match it with errors.As; ErrorJSON sends it to the client as the data of the error response
+type JSONError struct {
+	Kind     JSONErrorKind `json:"kind"`
+	Message  string        `json:"message"`
+	Field    string        `json:"field,omitempty"`
+	Offset   int64         `json:"offset,omitempty"`
+	Line     int           `json:"line,omitempty"`
+	Column   int           `json:"column,omitempty"`
+	Expected string        `json:"expected,omitempty"`
+	Actual   string        `json:"actual,omitempty"`
+	Limit    int64         `json:"limit,omitempty"`
+	Err      error         `json:"-"`
+}
+
+func (jsonError *JSONError) Error() string {
+	return jsonError.Message
+}
+
+func (jsonError *JSONError) Unwrap() error {
+	return jsonError.Err
+}
+
+// StatusCode is the HTTP status ErrorJSON uses for the error when none is given
+func (jsonError *JSONError) StatusCode() int {
+	switch jsonError.Kind {
+	case JSONErrorTooLarge, JSONErrorDecompressedTooLarge, JSONErrorTooManyItems:
+		return http.StatusRequestEntityTooLarge
+	case JSONErrorUnsupportedMediaType, JSONErrorUnsupportedEncoding:
+		return http.StatusUnsupportedMediaType
+	case JSONErrorInvalidTarget:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// jsonDecodeOptions controls how decodeJSON treats its input
+type jsonDecodeOptions struct {
+	maxBytes           int64
+	allowUnknownFields bool
+}
+
+// decodeJSON decodes exactly one JSON value from reader into data
+// any failure is returned as a *JSONError
+func decodeJSON(reader io.Reader, data interface{}, options jsonDecodeOptions) error {
+	// keep what the decoder consumes so offsets can be turned into lines and columns
+	var consumed bytes.Buffer
+	jsonDecoder := json.NewDecoder(io.TeeReader(stripBOM(reader), &consumed))
+
+	if !options.allowUnknownFields {
+		jsonDecoder.DisallowUnknownFields()
+	}
+
+	err := jsonDecoder.Decode(data)
+	if err != nil {
+		return classifyJSONError(err, consumed.Bytes(), jsonDecoder.InputOffset(), options.maxBytes)
+	}
+
+	err = jsonDecoder.Decode(&struct{}{})
+	if err != io.EOF {
+		jsonError := &JSONError{Kind: JSONErrorMultipleValues, Message: "body must contain only one JSON value", Offset: jsonDecoder.InputOffset(), Err: err}
+		if err != nil {
+			if classified, ok := classifyJSONError(err, consumed.Bytes(), jsonDecoder.InputOffset(), options.maxBytes).(*JSONError); ok {
+				switch classified.Kind {
+				case JSONErrorTooLarge, JSONErrorDecompressedTooLarge, JSONErrorCorruptEncoding:
+					return classified
+				}
+			}
+		}
+		jsonError.Line, jsonError.Column = position(consumed.Bytes(), jsonError.Offset)
+		return jsonError
+	}
+
+	return nil
+}
+
+// utf8BOM is the byte order mark some Windows tools write at the start of UTF-8 text
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// stripBOM skips a leading UTF-8 byte order mark, which encoding/json rejects as invalid
+func stripBOM(reader io.Reader) io.Reader {
+	bufferedReader := bufio.NewReader(reader)
+	if prefix, err := bufferedReader.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		_, _ = bufferedReader.Discard(len(utf8BOM))
+	}
+	return bufferedReader
+}
+
+// checkJSONContentType accepts application/json and any application/*+json type
+// a charset parameter, if present, must be UTF-8 as RFC 8259 requires
+func checkJSONContentType(contentType string) error {
+	unsupported := func(message string) error {
+		return &JSONError{
+			Kind:     JSONErrorUnsupportedMediaType,
+			Message:  message,
+			Expected: "application/json",
+			Actual:   contentType,
+		}
+	}
+
+	if contentType == "" {
+		return unsupported("Content-Type header must be application/json")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return unsupported("Content-Type header is malformed")
+	}
+	if mediaType != "application/json" && !(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")) {
+		return unsupported(fmt.Sprintf("Content-Type header %s is not supported, use application/json", mediaType))
+	}
+
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+		return unsupported(fmt.Sprintf("charset %s is not supported, use utf-8", charset))
+	}
+	return nil
+}
+
+// classifyJSONError turns an error from encoding/json into a *JSONError
+// consumed holds the bytes read by the decoder and inputOffset is where it stopped
+func classifyJSONError(err error, consumed []byte, inputOffset, maxBytes int64) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+	var maxBytesError *http.MaxBytesError
+	var decompressError *decompressionError
+
+	var jsonError *JSONError
+	switch {
+	case errors.As(err, &decompressError):
+		// checked first as decoder failures may wrap io.ErrUnexpectedEOF
+		jsonError = &JSONError{Kind: JSONErrorCorruptEncoding, Message: "body could not be decompressed"}
+	case errors.As(err, &syntaxError):
+		jsonError = &JSONError{
+			Kind:    JSONErrorSyntax,
+			Message: fmt.Sprintf("body contains badly-formed JSON (at character %d)", syntaxError.Offset),
+			Offset:  syntaxError.Offset,
+		}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		jsonError = &JSONError{Kind: JSONErrorTruncated, Message: "body contains badly-formed JSON", Offset: inputOffset}
+	case errors.As(err, &unmarshalTypeError):
+		jsonError = &JSONError{
+			Kind:     JSONErrorType,
+			Field:    unmarshalTypeError.Field,
+			Offset:   unmarshalTypeError.Offset,
+			Expected: unmarshalTypeError.Type.String(),
+			Actual:   unmarshalTypeError.Value,
+		}
+		if unmarshalTypeError.Field != "" {
+			jsonError.Message = fmt.Sprintf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+		} else {
+			jsonError.Message = fmt.Sprintf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+		}
+	case errors.Is(err, io.EOF):
+		jsonError = &JSONError{Kind: JSONErrorEmptyBody, Message: "body must not be empty"}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields, so this is the one text match left
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		if unquoted, unquoteErr := strconv.Unquote(fieldName); unquoteErr == nil {
+			fieldName = unquoted
+		}
+		jsonError = &JSONError{
+			Kind:    JSONErrorUnknownField,
+			Message: fmt.Sprintf("body contains unknown key %q", fieldName),
+			Field:   fieldName,
+			Offset:  inputOffset,
+		}
+	case errors.As(err, &maxBytesError):
+		jsonError = tooLargeError(err, maxBytes)
+	case errors.Is(err, errDecompressedTooLarge):
+		jsonError = &JSONError{
+			Kind:    JSONErrorDecompressedTooLarge,
+			Message: fmt.Sprintf("decompressed body must not be larger than %d bytes", maxBytes),
+			Limit:   maxBytes,
+		}
+	case errors.As(err, &invalidUnmarshalError):
+		return &JSONError{Kind: JSONErrorInvalidTarget, Message: fmt.Sprintf("error unmarshalling JSON: %s", err.Error()), Err: err}
+	default:
+		return err
+	}
+
+	jsonError.Err = err
+	jsonError.Line, jsonError.Column = position(consumed, jsonError.Offset)
+	return jsonError
+}
+
+// tooLargeError reports a body which exceeded the permitted number of bytes
+func tooLargeError(err error, maxBytes int64) *JSONError {
+	return &JSONError{
+		Kind:    JSONErrorTooLarge,
+		Message: fmt.Sprintf("body must not be larger than %d bytes", maxBytes),
+		Limit:   maxBytes,
+		Err:     err,
+	}
+}
+
+// position converts a byte offset into a one-based line and column
+func position(consumed []byte, offset int64) (int, int) {
+	if offset <= 0 {
+		return 0, 0
+	}
+	if offset > int64(len(consumed)) {
+		offset = int64(len(consumed))
+	}
+	before := consumed[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - (bytes.LastIndexByte(before, '\n') + 1)
+	if column == 0 {
+		column = 1
+	}
+	return line, column
+}
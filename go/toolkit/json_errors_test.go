@@ -0,0 +1,147 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var jsonErrorTests = []struct {
+	name           string
+	json           string
+	maxSize        int
+	expectedKind   JSONErrorKind
+	expectedField  string
+	expectedLine   int
+	expectedColumn int
+	expectedLimit  int64
+	expectedStatus int
+}{
+	{name: "syntax error", json: "{\n  \"foo\": bar\n}", maxSize: 1024, expectedKind: JSONErrorSyntax, expectedLine: 2, expectedColumn: 10, expectedStatus: http.StatusBadRequest},
+	{name: "truncated", json: `{"foo": "bar"`, maxSize: 1024, expectedKind: JSONErrorTruncated, expectedStatus: http.StatusBadRequest},
+	{name: "wrong type", json: `{"foo": 1}`, maxSize: 1024, expectedKind: JSONErrorType, expectedField: "foo", expectedLine: 1, expectedStatus: http.StatusBadRequest},
+	{name: "empty body", json: ``, maxSize: 1024, expectedKind: JSONErrorEmptyBody, expectedStatus: http.StatusBadRequest},
+	{name: "unknown field", json: `{"food": "bar"}`, maxSize: 1024, expectedKind: JSONErrorUnknownField, expectedField: "food", expectedStatus: http.StatusBadRequest},
+	{name: "too large", json: `{"foo": "barbarbarbar"}`, maxSize: 8, expectedKind: JSONErrorTooLarge, expectedLimit: 8, expectedStatus: http.StatusRequestEntityTooLarge},
+	{name: "multiple values", json: `{"foo": "bar"}{"foo": "baz"}`, maxSize: 1024, expectedKind: JSONErrorMultipleValues, expectedStatus: http.StatusBadRequest},
+}
+
+func TestTools_ReadJSONErrors(test *testing.T) {
+	for _, entry := range jsonErrorTests {
+		testTools := Tools{MaxJSONSize: entry.maxSize}
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		request := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		err := testTools.ReadJSON(httptest.NewRecorder(), request, &decodedJSON)
+
+		var jsonError *JSONError
+		if !errors.As(err, &jsonError) {
+			test.Errorf("%s: expected a *JSONError but got %v", entry.name, err)
+			continue
+		}
+		if jsonError.Kind != entry.expectedKind {
+			test.Errorf("%s: expected kind %s but got %s", entry.name, entry.expectedKind, jsonError.Kind)
+		}
+		if jsonError.Field != entry.expectedField {
+			test.Errorf("%s: expected field %q but got %q", entry.name, entry.expectedField, jsonError.Field)
+		}
+		if entry.expectedLine != 0 && jsonError.Line != entry.expectedLine {
+			test.Errorf("%s: expected line %d but got %d", entry.name, entry.expectedLine, jsonError.Line)
+		}
+		if entry.expectedColumn != 0 && jsonError.Column != entry.expectedColumn {
+			test.Errorf("%s: expected column %d but got %d", entry.name, entry.expectedColumn, jsonError.Column)
+		}
+		if jsonError.Limit != entry.expectedLimit {
+			test.Errorf("%s: expected limit %d but got %d", entry.name, entry.expectedLimit, jsonError.Limit)
+		}
+		if jsonError.StatusCode() != entry.expectedStatus {
+			test.Errorf("%s: expected status %d but got %d", entry.name, entry.expectedStatus, jsonError.StatusCode())
+		}
+	}
+}
+
+func TestTools_ErrorJSONWithJSONError(test *testing.T) {
+	var testTools Tools
+	responseRecorder := httptest.NewRecorder()
+
+	jsonError := &JSONError{Kind: JSONErrorTooLarge, Message: "body must not be larger than 8 bytes", Limit: 8}
+	err := testTools.ErrorJSON(responseRecorder, jsonError)
+	if err != nil {
+		test.Error(err)
+	}
+
+	if responseRecorder.Code != http.StatusRequestEntityTooLarge {
+		test.Errorf("wrong status code returned; expected 413, but got %d", responseRecorder.Code)
+	}
+
+	var payload struct {
+		Error   bool      `json:"error"`
+		Message string    `json:"message"`
+		Data    JSONError `json:"data"`
+	}
+	err = json.NewDecoder(responseRecorder.Body).Decode(&payload)
+	if err != nil {
+		test.Error("received error when decoding JSON", err)
+	}
+	if payload.Data.Kind != JSONErrorTooLarge || payload.Data.Limit != 8 || payload.Message != jsonError.Message {
+		test.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+var contentTypeTests = []struct {
+	name          string
+	contentType   string
+	body          string
+	require       bool
+	errorExpected bool
+}{
+	{name: "json", contentType: "application/json", body: `{"foo":"bar"}`, require: true, errorExpected: false},
+	{name: "json with utf-8 charset", contentType: "application/json; charset=UTF-8", body: `{"foo":"bar"}`, require: true, errorExpected: false},
+	{name: "json suffix", contentType: "application/merge-patch+json", body: `{"foo":"bar"}`, require: true, errorExpected: false},
+	{name: "form post", contentType: "application/x-www-form-urlencoded", body: `foo=bar`, require: true, errorExpected: true},
+	{name: "missing content type", contentType: "", body: `{"foo":"bar"}`, require: true, errorExpected: true},
+	{name: "other charset", contentType: "application/json; charset=iso-8859-1", body: `{"foo":"bar"}`, require: true, errorExpected: true},
+	{name: "not required", contentType: "text/plain", body: `{"foo":"bar"}`, require: false, errorExpected: false},
+	{name: "byte order mark", contentType: "application/json", body: "\xEF\xBB\xBF{\"foo\":\"bar\"}", require: true, errorExpected: false},
+}
+
+func TestTools_ReadJSONContentType(test *testing.T) {
+	for _, entry := range contentTypeTests {
+		testTools := Tools{RequireJSONContentType: entry.require}
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		request := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(entry.body)))
+		if entry.contentType != "" {
+			request.Header.Set("Content-Type", entry.contentType)
+		}
+		err := testTools.ReadJSON(httptest.NewRecorder(), request, &decodedJSON)
+
+		if !entry.errorExpected {
+			if err != nil {
+				test.Errorf("%s: error not expected, but one received: %s", entry.name, err.Error())
+			} else if decodedJSON.Foo != "bar" {
+				test.Errorf("%s: body was not decoded", entry.name)
+			}
+			continue
+		}
+
+		var jsonError *JSONError
+		if !errors.As(err, &jsonError) || jsonError.Kind != JSONErrorUnsupportedMediaType {
+			test.Errorf("%s: expected an unsupported media type error but got %v", entry.name, err)
+			continue
+		}
+
+		responseRecorder := httptest.NewRecorder()
+		_ = testTools.ErrorJSON(responseRecorder, err)
+		if responseRecorder.Code != http.StatusUnsupportedMediaType {
+			test.Errorf("%s: expected status 415 but got %d", entry.name, responseRecorder.Code)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// the json decoder reads ahead of the item it is decoding, so the guard on the underlying
+// body allows this much on top of the item limit before giving up
+const streamReadAheadSlack = 64 * 1024
+
+// errStreamItemTooLarge signals that the decoder read too far into a single item
+var errStreamItemTooLarge = errors.New("stream item too large")
+
+// JSONStreamError reports a failure reading an individual item of a JSON stream
+// when Fatal is false the stream is still usable and Next can be called again
+type JSONStreamError struct {
+	Index int
+	Fatal bool
+	Err   error
+}
+
+func (streamError *JSONStreamError) Error() string {
+	return fmt.Sprintf("item %d: %s", streamError.Index, streamError.Err.Error())
+}
+
+func (streamError *JSONStreamError) Unwrap() error {
+	return streamError.Err
+}
+
+// MarshalJSON gives ErrorJSON a stable shape for stream errors
+func (streamError *JSONStreamError) MarshalJSON() ([]byte, error) {
+	payload := struct {
+		Index   int         `json:"index"`
+		Message string      `json:"message"`
+		Detail  interface{} `json:"detail,omitempty"`
+	}{
+		Index:   streamError.Index,
+		Message: streamError.Err.Error(),
+	}
+
+	var jsonError *JSONError
+	var validationErrors ValidationErrors
+	switch {
+	case errors.As(streamError.Err, &jsonError):
+		payload.Detail = jsonError
+	case errors.As(streamError.Err, &validationErrors):
+		payload.Detail = validationErrors
+	}
+	return json.Marshal(payload)
+}
+
+// JSONStreamReader iterates over the elements of a top-level JSON array, or the records of
+// a newline-delimited JSON (NDJSON) body, one item at a time
+type JSONStreamReader struct {
+	tools       *Tools
+	ndjson      bool
+	decoder     *json.Decoder
+	guard       *streamGuardReader
+	lines       *bufio.Reader
+	maxItemSize int64
+	maxItems    int
+	index       int
+	started     bool
+	err         error
+	closeBody   func()
+}
+
+// NewJSONStreamReader prepares to read a request body item by item
+// the body is treated as NDJSON when its Content-Type is application/x-ndjson (or jsonl),
+// or when it does not start with '['; otherwise it is read as a JSON array
+// MaxJSONSize does not apply to streams: MaxJSONStreamItemSize limits each item (default one megabyte)
+// and MaxJSONStreamItems, if set, limits how many items are read
+func (tools *Tools) NewJSONStreamReader(responseWriter http.ResponseWriter, request *http.Request) (*JSONStreamReader, error) {
+	contentType := request.Header.Get("Content-Type")
+	ndjson := isStreamContentType(contentType)
+
+	if tools.RequireJSONContentType && !ndjson {
+		if err := checkJSONContentType(contentType); err != nil {
+			return nil, err
+		}
+	}
+
+	maxItemSize := int64(megabyte)
+	if tools.MaxJSONStreamItemSize != 0 {
+		maxItemSize = int64(tools.MaxJSONStreamItemSize)
+	}
+
+	body, closeBody, err := decompressBody(request.Body, request.Header.Get("Content-Encoding"), tools.ContentDecoders, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	streamReader := &JSONStreamReader{
+		tools:       tools,
+		maxItemSize: maxItemSize,
+		maxItems:    tools.MaxJSONStreamItems,
+		index:       -1,
+		closeBody:   closeBody,
+	}
+
+	bufferedBody := bufio.NewReader(stripBOM(body))
+	if !ndjson {
+		ndjson = !startsWithArray(bufferedBody)
+	}
+
+	streamReader.ndjson = ndjson
+	if ndjson {
+		streamReader.lines = bufferedBody
+	} else {
+		streamReader.guard = &streamGuardReader{reader: bufferedBody, limit: maxItemSize + streamReadAheadSlack}
+		streamReader.decoder = json.NewDecoder(streamReader.guard)
+	}
+	return streamReader, nil
+}
+
+// startsWithArray peeks past any leading whitespace to see if the body is a JSON array
+func startsWithArray(reader *bufio.Reader) bool {
+	for peekSize := 1; ; peekSize++ {
+		peeked, err := reader.Peek(peekSize)
+		if len(peeked) < peekSize {
+			return false
+		}
+		switch peeked[peekSize-1] {
+		case ' ', '\t', '\r', '\n':
+			if err != nil {
+				return false
+			}
+			continue
+		case '[':
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// Index returns the position of the item most recently returned by Next
+func (streamReader *JSONStreamReader) Index() int {
+	return streamReader.index
+}
+
+// Next decodes the next item into data and, when ValidateJSON is set, validates it
+// returns io.EOF once every item has been read
+// problems with a single item are returned as a *JSONStreamError; if it is not Fatal,
+// reading can continue with the following item
+func (streamReader *JSONStreamReader) Next(data interface{}) error {
+	if streamReader.err != nil {
+		return streamReader.err
+	}
+
+	var raw []byte
+	var err error
+	if streamReader.ndjson {
+		raw, err = streamReader.nextLine()
+	} else {
+		raw, err = streamReader.nextElement()
+	}
+	if err != nil {
+		if err != io.EOF {
+			err = &JSONStreamError{Index: streamReader.index + 1, Fatal: true, Err: err}
+		}
+		streamReader.err = err
+		return err
+	}
+
+	streamReader.index++
+	if streamReader.maxItems > 0 && streamReader.index >= streamReader.maxItems {
+		streamReader.err = &JSONStreamError{Index: streamReader.index, Fatal: true, Err: &JSONError{
+			Kind:    JSONErrorTooManyItems,
+			Message: fmt.Sprintf("body must not contain more than %d items", streamReader.maxItems),
+			Limit:   int64(streamReader.maxItems),
+		}}
+		return streamReader.err
+	}
+
+	err = decodeJSON(bytes.NewReader(raw), data, jsonDecodeOptions{
+		maxBytes:           streamReader.maxItemSize,
+		allowUnknownFields: streamReader.tools.AllowUnknownFields,
+	})
+	if err == nil && streamReader.tools.ValidateJSON {
+		err = streamReader.tools.ValidateStruct(data)
+	}
+	if err != nil {
+		return &JSONStreamError{Index: streamReader.index, Err: err}
+	}
+	return nil
+}
+
+// nextElement reads the raw bytes of the next element of a JSON array
+func (streamReader *JSONStreamReader) nextElement() ([]byte, error) {
+	decoder := streamReader.decoder
+	if !streamReader.started {
+		streamReader.started = true
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, streamReader.classify(err)
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, &JSONError{Kind: JSONErrorSyntax, Message: "body must be a JSON array"}
+		}
+	}
+
+	if !decoder.More() {
+		if _, err := decoder.Token(); err != nil {
+			return nil, streamReader.classify(err)
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, &JSONError{Kind: JSONErrorMultipleValues, Message: "body must contain only one JSON array", Offset: decoder.InputOffset()}
+		}
+		return nil, io.EOF
+	}
+
+	streamReader.guard.reset()
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, streamReader.classify(err)
+	}
+	if int64(len(raw)) > streamReader.maxItemSize {
+		return nil, streamReader.itemTooLarge()
+	}
+	return raw, nil
+}
+
+// nextLine reads the next non-blank line of an NDJSON body
+func (streamReader *JSONStreamReader) nextLine() ([]byte, error) {
+	for {
+		var line []byte
+		for {
+			fragment, err := streamReader.lines.ReadSlice('\n')
+			line = append(line, fragment...)
+			if int64(len(bytes.TrimRight(line, "\r\n"))) > streamReader.maxItemSize {
+				return nil, streamReader.itemTooLarge()
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return nil, streamReader.classify(err)
+			}
+			if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			return trimmed, nil
+		}
+	}
+}
+
+// classify converts read and syntax errors from the stream into *JSONError
+func (streamReader *JSONStreamReader) classify(err error) error {
+	if errors.Is(err, errStreamItemTooLarge) {
+		return streamReader.itemTooLarge()
+	}
+	return classifyJSONError(err, nil, 0, streamReader.maxItemSize)
+}
+
+func (streamReader *JSONStreamReader) itemTooLarge() error {
+	return &JSONError{
+		Kind:    JSONErrorTooLarge,
+		Message: fmt.Sprintf("item must not be larger than %d bytes", streamReader.maxItemSize),
+		Limit:   streamReader.maxItemSize,
+	}
+}
+
+// Close releases any decompressor used for the body
+func (streamReader *JSONStreamReader) Close() error {
+	streamReader.closeBody()
+	return nil
+}
+
+// ReadJSONStream reads every item of a JSON array or NDJSON body
+// newItem returns a pointer to decode each item into, which is then passed to handler
+// stops at the first error, returning it as a *JSONStreamError, along with the number of items handled
+func (tools *Tools) ReadJSONStream(responseWriter http.ResponseWriter, request *http.Request, newItem func() interface{}, handler func(index int, item interface{}) error) (int, error) {
+	streamReader, err := tools.NewJSONStreamReader(responseWriter, request)
+	if err != nil {
+		return 0, err
+	}
+	defer streamReader.Close()
+
+	count := 0
+	for {
+		item := newItem()
+		err := streamReader.Next(item)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err := handler(streamReader.Index(), item); err != nil {
+			return count, &JSONStreamError{Index: streamReader.Index(), Err: err}
+		}
+		count++
+	}
+}
+
+// streamGuardReader stops the decoder reading an unbounded amount for a single item
+type streamGuardReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (guard *streamGuardReader) Read(p []byte) (int, error) {
+	if guard.read >= guard.limit {
+		return 0, errStreamItemTooLarge
+	}
+	if remaining := guard.limit - guard.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := guard.reader.Read(p)
+	guard.read += int64(n)
+	return n, err
+}
+
+// reset starts counting afresh for the next item
+func (guard *streamGuardReader) reset() {
+	guard.read = 0
+}
+
+// isStreamContentType reports whether contentType names a newline-delimited JSON format
+func isStreamContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(mediaType, "ndjson") || mediaType == "application/jsonl"
+}
+
+// StreamErrorTrailer is the HTTP trailer WriteJSONStream sets when a stream ends early because of an error
+const StreamErrorTrailer = "X-Stream-Error"
+
+// jsonStreamWriter writes the framing of a JSON array or NDJSON response
+type jsonStreamWriter struct {
+	responseWriter http.ResponseWriter
+	flusher        http.Flusher
+	marshal        func(data interface{}, pretty bool) ([]byte, error)
+	prefix         string
+	ndjson         bool
+	flushEvery     int
+	written        int
+	unflushed      int
+}
+
+func (streamWriter *jsonStreamWriter) begin() error {
+	if streamWriter.ndjson {
+		return nil
+	}
+	// a top level array is what a cross site <script> include can read, so it gets the prefix
+	_, err := io.WriteString(streamWriter.responseWriter, streamWriter.prefix+"[")
+	return err
+}
+
+func (streamWriter *jsonStreamWriter) item(data interface{}) error {
+	output, err := streamWriter.marshal(data, false)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case streamWriter.ndjson:
+		output = append(output, '\n')
+	case streamWriter.written > 0:
+		output = append([]byte{','}, output...)
+	}
+	if _, err := streamWriter.responseWriter.Write(output); err != nil {
+		return err
+	}
+
+	streamWriter.written++
+	streamWriter.unflushed++
+	if streamWriter.unflushed >= streamWriter.flushEvery {
+		streamWriter.flush()
+	}
+	return nil
+}
+
+func (streamWriter *jsonStreamWriter) flush() {
+	if streamWriter.flusher != nil && streamWriter.unflushed > 0 {
+		streamWriter.flusher.Flush()
+	}
+	streamWriter.unflushed = 0
+}
+
+// end closes the document so what the client received is valid JSON, even after an error
+func (streamWriter *jsonStreamWriter) end() error {
+	if !streamWriter.ndjson {
+		if _, err := io.WriteString(streamWriter.responseWriter, "]"); err != nil {
+			return err
+		}
+	}
+	streamWriter.unflushed++
+	streamWriter.flush()
+	return nil
+}
+
+// trailerValue replaces the control characters in message, such as CR and LF, which would break the trailer
+func trailerValue(message string) string {
+	return strings.Map(func(char rune) rune {
+		if char < ' ' || char == 0x7f {
+			return ' '
+		}
+		return char
+	}, message)
+}
+
+// prefersNDJSON reports whether an Accept header asks for NDJSON ahead of plain JSON, by quality
+func prefersNDJSON(accept string) bool {
+	for _, mediaRange := range sortByQuality(accept) {
+		mediaType, _, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		if isStreamContentType(mediaType) {
+			return true
+		}
+		if mediaType == "application/json" {
+			return false
+		}
+	}
+	return false
+}
+
+// WriteJSONStream writes the items returned by next as a JSON array, or as NDJSON when the
+// request's Accept header asks for application/x-ndjson, without holding the whole payload in memory
+// next returns io.EOF when there are no more items
+// output is flushed every JSONStreamFlushEvery items (default 100)
+// DisableHTMLEscape and NoSniff apply as they do for WriteJSON, and JSONPrefix is written before a
+// JSON array, but not NDJSON, which can not be read by a <script> include
+// if the client disconnects the request context's error is returned
+// if next or marshalling fails the document is still terminated cleanly, the error is reported
+// in the X-Stream-Error trailer, masked as ErrorJSON would mask it, and returned
+func (tools *Tools) WriteJSONStream(responseWriter http.ResponseWriter, request *http.Request, status int, next func() (interface{}, error), headers ...http.Header) error {
+	streamWriter := tools.newJSONStreamWriter(responseWriter, request)
+	return tools.writeJSONStream(streamWriter, request, status, next, headers...)
+}
+
+// WriteJSONStreamChannel writes every item received from items until the channel is closed
+// sending an error on the channel aborts the stream as a failed next would in WriteJSONStream
+// pending output is flushed whenever the channel has nothing ready
+func (tools *Tools) WriteJSONStreamChannel(responseWriter http.ResponseWriter, request *http.Request, status int, items <-chan interface{}, headers ...http.Header) error {
+	streamWriter := tools.newJSONStreamWriter(responseWriter, request)
+	ctx := request.Context()
+
+	received := func(item interface{}, ok bool) (interface{}, error) {
+		if !ok {
+			return nil, io.EOF
+		}
+		if err, isError := item.(error); isError {
+			return nil, err
+		}
+		return item, nil
+	}
+
+	next := func() (interface{}, error) {
+		select {
+		case item, ok := <-items:
+			return received(item, ok)
+		default:
+		}
+
+		// nothing is ready, so send what we have while waiting
+		streamWriter.flush()
+		select {
+		case item, ok := <-items:
+			return received(item, ok)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return tools.writeJSONStream(streamWriter, request, status, next, headers...)
+}
+
+func (tools *Tools) newJSONStreamWriter(responseWriter http.ResponseWriter, request *http.Request) *jsonStreamWriter {
+	flushEvery := 100
+	if tools.JSONStreamFlushEvery > 0 {
+		flushEvery = tools.JSONStreamFlushEvery
+	}
+	flusher, _ := responseWriter.(http.Flusher)
+
+	return &jsonStreamWriter{
+		responseWriter: responseWriter,
+		flusher:        flusher,
+		marshal:        tools.marshalJSON,
+		prefix:         tools.JSONPrefix,
+		ndjson:         prefersNDJSON(request.Header.Get("Accept")),
+		flushEvery:     flushEvery,
+	}
+}
+
+func (tools *Tools) writeJSONStream(streamWriter *jsonStreamWriter, request *http.Request, status int, next func() (interface{}, error), headers ...http.Header) error {
+	responseWriter := streamWriter.responseWriter
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			responseWriter.Header()[key] = value
+		}
+	}
+	if streamWriter.ndjson {
+		responseWriter.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		responseWriter.Header().Set("Content-Type", "application/json")
+	}
+	if tools.NoSniff {
+		responseWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	responseWriter.Header().Set("Trailer", StreamErrorTrailer)
+	responseWriter.WriteHeader(status)
+
+	if err := streamWriter.begin(); err != nil {
+		return err
+	}
+	streamWriter.unflushed++
+	streamWriter.flush()
+
+	ctx := request.Context()
+	for {
+		if err := ctx.Err(); err != nil {
+			// the client has gone, so there is no one to terminate the document for
+			return err
+		}
+
+		item, err := next()
+		if err == io.EOF {
+			return streamWriter.end()
+		}
+		if err == nil {
+			err = streamWriter.item(item)
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			responseWriter.Header().Set(StreamErrorTrailer, trailerValue(tools.resolveError(err).message))
+			_ = streamWriter.end()
+			return err
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package toolkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type streamRecord struct {
+	ID   int    `json:"id"`
+	Name string `json:"name" validate:"required"`
+}
+
+var jsonStreamTests = []struct {
+	name          string
+	contentType   string
+	body          string
+	maxItemSize   int
+	maxItems      int
+	expectedIDs   []int
+	expectedError int
+	errorIndex    int
+	expectedKind  JSONErrorKind
+}{
+	{name: "array", contentType: "application/json", body: `[{"id":1,"name":"a"}, {"id":2,"name":"b"}]`, expectedIDs: []int{1, 2}, expectedError: -1},
+	{name: "empty array", contentType: "application/json", body: ` [ ] `, expectedIDs: nil, expectedError: -1},
+	{name: "ndjson by content type", contentType: "application/x-ndjson", body: "{\"id\":1,\"name\":\"a\"}\n\n{\"id\":2,\"name\":\"b\"}\n", expectedIDs: []int{1, 2}, expectedError: -1},
+	{name: "ndjson detected", contentType: "", body: "{\"id\":1,\"name\":\"a\"}\r\n{\"id\":2,\"name\":\"b\"}", expectedIDs: []int{1, 2}, expectedError: -1},
+	{name: "bad item in array is skipped", contentType: "application/json", body: `[{"id":1,"name":"a"},{"id":"two","name":"b"},{"id":3,"name":"c"}]`, expectedIDs: []int{1, 3}, expectedError: 1, errorIndex: 1, expectedKind: JSONErrorType},
+	{name: "invalid ndjson record is skipped", contentType: "application/x-ndjson", body: "{\"id\":1}\n{\"id\":2,\"name\":\"b\"}\n", expectedIDs: []int{2}, expectedError: 1, errorIndex: 0},
+	{name: "item too large", contentType: "application/json", maxItemSize: 30, body: `[{"id":1,"name":"a"},{"id":2,"name":"` + strings.Repeat("b", 50) + `"}]`, expectedIDs: []int{1}, expectedError: 1, errorIndex: 1, expectedKind: JSONErrorTooLarge},
+	{name: "ndjson line too large", contentType: "application/x-ndjson", maxItemSize: 30, body: "{\"id\":1,\"name\":\"a\"}\n{\"id\":2,\"name\":\"" + strings.Repeat("b", 5000) + "\"}\n", expectedIDs: []int{1}, expectedError: 1, errorIndex: 1, expectedKind: JSONErrorTooLarge},
+	{name: "too many items", contentType: "application/json", maxItems: 2, body: `[{"id":1,"name":"a"},{"id":2,"name":"b"},{"id":3,"name":"c"}]`, expectedIDs: []int{1, 2}, expectedError: 1, errorIndex: 2, expectedKind: JSONErrorTooManyItems},
+	{name: "broken array", contentType: "application/json", body: `[{"id":1,"name":"a"},{"id":2`, expectedIDs: []int{1}, expectedError: 1, errorIndex: 1, expectedKind: JSONErrorTruncated},
+	{name: "trailing data", contentType: "application/json", body: `[{"id":1,"name":"a"}] {}`, expectedIDs: []int{1}, expectedError: 1, errorIndex: 1, expectedKind: JSONErrorMultipleValues},
+}
+
+func TestTools_JSONStreamReader(test *testing.T) {
+	for _, entry := range jsonStreamTests {
+		testTools := Tools{MaxJSONStreamItemSize: entry.maxItemSize, MaxJSONStreamItems: entry.maxItems, ValidateJSON: true}
+		request := httptest.NewRequest("POST", "/", strings.NewReader(entry.body))
+		if entry.contentType != "" {
+			request.Header.Set("Content-Type", entry.contentType)
+		}
+
+		streamReader, err := testTools.NewJSONStreamReader(httptest.NewRecorder(), request)
+		if err != nil {
+			test.Errorf("%s: failed to create stream reader: %v", entry.name, err)
+			continue
+		}
+
+		var ids []int
+		var streamErrors []*JSONStreamError
+		for {
+			var record streamRecord
+			err := streamReader.Next(&record)
+			if err == io.EOF {
+				break
+			}
+			var streamError *JSONStreamError
+			if errors.As(err, &streamError) {
+				streamErrors = append(streamErrors, streamError)
+				if streamError.Fatal {
+					break
+				}
+				continue
+			}
+			if err != nil {
+				test.Errorf("%s: unexpected error %v", entry.name, err)
+				break
+			}
+			ids = append(ids, record.ID)
+		}
+		_ = streamReader.Close()
+
+		if fmt.Sprint(ids) != fmt.Sprint(entry.expectedIDs) {
+			test.Errorf("%s: expected ids %v but got %v", entry.name, entry.expectedIDs, ids)
+		}
+		if entry.expectedError < 0 {
+			if len(streamErrors) > 0 {
+				test.Errorf("%s: unexpected errors %v", entry.name, streamErrors)
+			}
+			continue
+		}
+		if len(streamErrors) != entry.expectedError {
+			test.Errorf("%s: expected %d errors but got %v", entry.name, entry.expectedError, streamErrors)
+			continue
+		}
+		if streamErrors[0].Index != entry.errorIndex {
+			test.Errorf("%s: expected error at index %d but got %d", entry.name, entry.errorIndex, streamErrors[0].Index)
+		}
+		if entry.expectedKind != "" {
+			var jsonError *JSONError
+			if !errors.As(streamErrors[0], &jsonError) || jsonError.Kind != entry.expectedKind {
+				test.Errorf("%s: expected a %s error but got %v", entry.name, entry.expectedKind, streamErrors[0])
+			}
+		}
+	}
+}
+
+func TestTools_ReadJSONStream(test *testing.T) {
+	var testTools Tools
+	var body strings.Builder
+	for idx := 0; idx < 10000; idx++ {
+		fmt.Fprintf(&body, "{\"id\":%d,\"name\":\"record %d\"}\n", idx, idx)
+	}
+	request := httptest.NewRequest("POST", "/", strings.NewReader(body.String()))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	total := 0
+	count, err := testTools.ReadJSONStream(httptest.NewRecorder(), request, func() interface{} {
+		return &streamRecord{}
+	}, func(index int, item interface{}) error {
+		record := item.(*streamRecord)
+		if record.ID != index {
+			return fmt.Errorf("record %d arrived at index %d", record.ID, index)
+		}
+		total += record.ID
+		return nil
+	})
+	if err != nil {
+		test.Error(err)
+	}
+	if count != 10000 || total != 49995000 {
+		test.Errorf("expected 10000 records but handled %d", count)
+	}
+
+	request = httptest.NewRequest("POST", "/", strings.NewReader(`[{"id":1,"name":"a"},{"id":2,"name":"b"}]`))
+	_, err = testTools.ReadJSONStream(httptest.NewRecorder(), request, func() interface{} {
+		return &streamRecord{}
+	}, func(index int, item interface{}) error {
+		if index == 1 {
+			return errors.New("duplicate record")
+		}
+		return nil
+	})
+	var streamError *JSONStreamError
+	if !errors.As(err, &streamError) || streamError.Index != 1 {
+		test.Errorf("expected handler error at index 1 but got %v", err)
+	}
+}
+
+// countingIterator returns n records, failing at failAt if it is not negative
+func countingIterator(n, failAt int) func() (interface{}, error) {
+	current := 0
+	return func() (interface{}, error) {
+		if current == failAt {
+			return nil, errors.New("database went away")
+		}
+		if current >= n {
+			return nil, io.EOF
+		}
+		current++
+		return streamRecord{ID: current - 1, Name: "record"}, nil
+	}
+}
+
+var writeJSONStreamTests = []struct {
+	name            string
+	accept          string
+	items           int
+	failAt          int
+	expectedType    string
+	expectedTrailer string
+}{
+	{name: "array", accept: "application/json", items: 250, failAt: -1, expectedType: "application/json"},
+	{name: "empty array", accept: "", items: 0, failAt: -1, expectedType: "application/json"},
+	{name: "ndjson", accept: "application/x-ndjson, application/json;q=0.5", items: 250, failAt: -1, expectedType: "application/x-ndjson"},
+	{name: "ndjson less preferred", accept: "application/x-ndjson;q=0.5, application/json", items: 10, failAt: -1, expectedType: "application/json"},
+	{name: "ndjson refused", accept: "application/x-ndjson;q=0, */*", items: 10, failAt: -1, expectedType: "application/json"},
+	{name: "array error", accept: "application/json", items: 250, failAt: 120, expectedType: "application/json", expectedTrailer: genericErrorMessage},
+	{name: "ndjson error", accept: "application/x-ndjson", items: 250, failAt: 120, expectedType: "application/x-ndjson", expectedTrailer: genericErrorMessage},
+}
+
+func TestTools_WriteJSONStream(test *testing.T) {
+	for _, entry := range writeJSONStreamTests {
+		var testTools Tools
+		var streamErr error
+		server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			streamErr = testTools.WriteJSONStream(responseWriter, request, http.StatusOK, countingIterator(entry.items, entry.failAt))
+		}))
+
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		if entry.accept != "" {
+			request.Header.Set("Accept", entry.accept)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		// read the body through a stream reader to prove the document is well formed
+		readRequest := httptest.NewRequest("POST", "/", response.Body)
+		readRequest.Header.Set("Content-Type", response.Header.Get("Content-Type"))
+		count, err := testTools.ReadJSONStream(httptest.NewRecorder(), readRequest, func() interface{} {
+			return &streamRecord{}
+		}, func(index int, item interface{}) error {
+			return nil
+		})
+		_ = response.Body.Close()
+		server.Close()
+
+		if err != nil {
+			test.Errorf("%s: output is not a valid stream: %v", entry.name, err)
+		}
+		expectedCount := entry.items
+		if entry.failAt >= 0 {
+			expectedCount = entry.failAt
+			if streamErr == nil {
+				test.Errorf("%s: expected WriteJSONStream to return the iterator error", entry.name)
+			}
+		}
+		if count != expectedCount {
+			test.Errorf("%s: expected %d items but read %d", entry.name, expectedCount, count)
+		}
+		if response.Header.Get("Content-Type") != entry.expectedType {
+			test.Errorf("%s: expected content type %s but got %s", entry.name, entry.expectedType, response.Header.Get("Content-Type"))
+		}
+		if response.Trailer.Get(StreamErrorTrailer) != entry.expectedTrailer {
+			test.Errorf("%s: expected trailer %q but got %q", entry.name, entry.expectedTrailer, response.Trailer.Get(StreamErrorTrailer))
+		}
+	}
+}
+
+func TestTools_WriteJSONStreamChannel(test *testing.T) {
+	testTools := Tools{JSONStreamFlushEvery: 1}
+	items := make(chan interface{})
+	go func() {
+		defer close(items)
+		for idx := 0; idx < 5; idx++ {
+			items <- streamRecord{ID: idx, Name: "record"}
+		}
+	}()
+
+	request := httptest.NewRequest("GET", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	err := testTools.WriteJSONStreamChannel(responseRecorder, request, http.StatusOK, items)
+	if err != nil {
+		test.Error(err)
+	}
+
+	var records []streamRecord
+	if err := json.Unmarshal(responseRecorder.Body.Bytes(), &records); err != nil {
+		test.Errorf("output is not a JSON array: %v", err)
+	}
+	if len(records) != 5 || records[4].ID != 4 {
+		test.Errorf("unexpected records %v", records)
+	}
+	if !responseRecorder.Flushed {
+		test.Error("expected the response to be flushed")
+	}
+}
+
+func TestTools_WriteJSONStreamDisconnect(test *testing.T) {
+	var testTools Tools
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+	items := make(chan interface{})
+	go func() {
+		items <- streamRecord{ID: 1, Name: "record"}
+		cancel()
+	}()
+
+	err := testTools.WriteJSONStreamChannel(httptest.NewRecorder(), request, http.StatusOK, items)
+	if !errors.Is(err, context.Canceled) {
+		test.Errorf("expected context.Canceled but got %v", err)
+	}
+}
+
+func TestTools_WriteJSONStreamTrailerSanitized(test *testing.T) {
+	testTools := Tools{ExposeUnknownErrors: true}
+	next := func() (interface{}, error) {
+		return nil, errors.New("database went away\r\nX-Injected: true")
+	}
+	responseRecorder := httptest.NewRecorder()
+	_ = testTools.WriteJSONStream(responseRecorder, httptest.NewRequest("GET", "/", nil), http.StatusOK, next)
+
+	trailer := responseRecorder.Result().Trailer.Get(StreamErrorTrailer)
+	if trailer != "database went away  X-Injected: true" {
+		test.Errorf("expected control characters to be replaced but got %q", trailer)
+	}
+}
+
+func TestTools_WriteJSONStreamHardened(test *testing.T) {
+	items := []interface{}{streamRecord{ID: 1, Name: "<script>"}}
+	tests := []struct {
+		name     string
+		accept   string
+		expected string
+	}{
+		{name: "array", accept: "application/json", expected: XSSIPrefix + `[{"id":1,"name":"<script>"}]`},
+		{name: "ndjson", accept: "application/x-ndjson", expected: `{"id":1,"name":"<script>"}` + "\n"},
+	}
+
+	for _, entry := range tests {
+		testTools := Tools{JSONPrefix: XSSIPrefix, NoSniff: true, DisableHTMLEscape: true}
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Accept", entry.accept)
+		responseRecorder := httptest.NewRecorder()
+
+		remaining := items
+		err := testTools.WriteJSONStream(responseRecorder, request, http.StatusOK, func() (interface{}, error) {
+			if len(remaining) == 0 {
+				return nil, io.EOF
+			}
+			item := remaining[0]
+			remaining = remaining[1:]
+			return item, nil
+		})
+		if err != nil {
+			test.Fatal(err)
+		}
+		if responseRecorder.Body.String() != entry.expected {
+			test.Errorf("%s: expected %q but got %q", entry.name, entry.expected, responseRecorder.Body.String())
+		}
+		if responseRecorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+			test.Errorf("%s: expected X-Content-Type-Options: nosniff", entry.name)
+		}
+	}
+}
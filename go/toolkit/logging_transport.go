@@ -0,0 +1,193 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces redacted headers, query parameters and JSON fields in logs
+const redactedValue = "[REDACTED]"
+
+// default number of bytes of each body LoggingTransport logs
+const defaultMaxLoggedBody = 4096
+
+// defaultRedactedHeaders are always redacted by LoggingTransport
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", DefaultWebhookSignatureHeader}
+
+// LoggingTransport is an http.RoundTripper which logs each request and response with slog
+// it logs the method, URL, status and latency at info level, or at error level when the request
+// fails, and with LogBodies the bodies, truncated to MaxBodySize
+// Authorization, Proxy-Authorization, Cookie, Set-Cookie and Webhook-Signature headers are always
+// redacted, along with RedactHeaders, RedactQuery parameters and the JSON fields in RedactFields;
+// bodies which can not be redacted, being compressed or, with RedactFields, not JSON, are left out
+// use it as the Transport of the http.Client given to JSONClient or PostJSONToRemote:
+//
+//	client.HTTPClient.Transport = &toolkit.LoggingTransport{Logger: logger, LogBodies: true}
+type LoggingTransport struct {
+	// Transport sends the requests; http.DefaultTransport when nil
+	Transport http.RoundTripper
+	// Logger receives the logs; slog.Default() when nil
+	Logger *slog.Logger
+	// LogHeaders adds the request and response headers to the logs
+	LogHeaders bool
+	// LogBodies adds the request and response bodies to the logs
+	LogBodies bool
+	// MaxBodySize is the number of bytes of each body logged; 4096 when zero
+	MaxBodySize int
+	// RedactHeaders are further headers whose values are replaced in the logs
+	RedactHeaders []string
+	// RedactQuery are query parameters whose values are replaced in the logged URL
+	RedactQuery []string
+	// RedactFields are dotted paths of JSON fields whose values are replaced in logged bodies,
+	// such as "password" or "card.number"; a path matches the field in every element of an array
+	RedactFields []string
+}
+
+// RoundTrip sends request and logs the exchange
+func (transport *LoggingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	next := transport.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	logger := transport.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	attributes := []slog.Attr{
+		slog.String("method", request.Method),
+		slog.String("url", transport.redactURL(request.URL)),
+	}
+	if transport.LogHeaders {
+		attributes = append(attributes, slog.Any("request_headers", transport.redactHeaders(request.Header)))
+	}
+	if transport.LogBodies && request.GetBody != nil {
+		if body, err := request.GetBody(); err == nil {
+			data, _ := io.ReadAll(io.LimitReader(body, int64(transport.maxBodySize())+1))
+			_ = body.Close()
+			attributes = append(attributes, slog.String("request_body", transport.redactBody(data, request.Header)))
+		}
+	}
+
+	started := time.Now()
+	response, err := next.RoundTrip(request)
+	attributes = append(attributes, slog.Duration("latency", time.Since(started)))
+	if err != nil {
+		attributes = append(attributes, slog.String("error", err.Error()))
+		logger.LogAttrs(request.Context(), slog.LevelError, "outbound request failed", attributes...)
+		return response, err
+	}
+
+	attributes = append(attributes, slog.Int("status", response.StatusCode))
+	if transport.LogHeaders {
+		attributes = append(attributes, slog.Any("response_headers", transport.redactHeaders(response.Header)))
+	}
+	if transport.LogBodies && response.Body != nil {
+		// read the start of the body for the log, then put it back in front of the rest
+		data, readErr := io.ReadAll(io.LimitReader(response.Body, int64(transport.maxBodySize())+1))
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), response.Body), response.Body}
+		if readErr == nil {
+			attributes = append(attributes, slog.String("response_body", transport.redactBody(data, response.Header)))
+		}
+	}
+	logger.LogAttrs(request.Context(), slog.LevelInfo, "outbound request", attributes...)
+	return response, nil
+}
+
+func (transport *LoggingTransport) maxBodySize() int {
+	if transport.MaxBodySize > 0 {
+		return transport.MaxBodySize
+	}
+	return defaultMaxLoggedBody
+}
+
+// redactURL returns the URL without its password and with RedactQuery parameters replaced
+func (transport *LoggingTransport) redactURL(target *url.URL) string {
+	redacted := *target
+	if len(transport.RedactQuery) > 0 && redacted.RawQuery != "" {
+		query := redacted.Query()
+		for _, parameter := range transport.RedactQuery {
+			if query.Has(parameter) {
+				query.Set(parameter, redactedValue)
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.Redacted()
+}
+
+// redactHeaders copies header with the values of redacted headers replaced
+func (transport *LoggingTransport) redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range append(defaultRedactedHeaders, transport.RedactHeaders...) {
+		if _, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+			redacted.Set(name, redactedValue)
+		}
+	}
+	return redacted
+}
+
+// redactBody prepares a body for the log, replacing RedactFields when it is JSON and truncating it
+// a compressed body is unreadable and can not be redacted, so it is always left out of the log;
+// so is a truncated or non-JSON body when fields are to be redacted, as it can not be parsed
+func (transport *LoggingTransport) redactBody(data []byte, header http.Header) string {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return "[body not logged: " + encoding + " encoded]"
+	}
+	truncated := len(data) > transport.maxBodySize()
+	if truncated {
+		data = data[:transport.maxBodySize()]
+	}
+	if len(transport.RedactFields) == 0 || len(data) == 0 {
+		return truncatedBody(string(data), truncated)
+	}
+
+	var document interface{}
+	if !truncated && json.Unmarshal(data, &document) == nil {
+		for _, field := range transport.RedactFields {
+			redactJSONPath(document, strings.Split(field, "."))
+		}
+		if redacted, err := json.Marshal(document); err == nil {
+			return string(redacted)
+		}
+	}
+	// without a complete JSON document, drop the body rather than risk logging a secret
+	return "[body not logged: fields could not be redacted]"
+}
+
+// truncatedBody marks a body which was cut short
+func truncatedBody(body string, truncated bool) string {
+	if truncated {
+		return body + "...[truncated]"
+	}
+	return body
+}
+
+// redactJSONPath replaces the value at path in a decoded JSON document, descending into arrays
+func redactJSONPath(document interface{}, path []string) {
+	switch value := document.(type) {
+	case map[string]interface{}:
+		child, ok := value[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			value[path[0]] = redactedValue
+			return
+		}
+		redactJSONPath(child, path[1:])
+	case []interface{}:
+		for _, element := range value {
+			redactJSONPath(element, path)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// decodeLogs reads the JSON log entries written to logs
+func decodeLogs(test *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	decoder := json.NewDecoder(logs)
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			test.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLoggingTransport(test *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("Set-Cookie", "session=abc")
+		responseWriter.Header().Set("Content-Type", "application/json")
+		_, _ = responseWriter.Write([]byte(`{"token":"tok_123","users":[{"name":"a","password":"one"},{"name":"b","password":"two"}]}`))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	client, _ := NewJSONClient(server.URL)
+	client.Auth = BearerToken("secret-token")
+	client.HTTPClient.Transport = &LoggingTransport{
+		Logger:       slog.New(slog.NewJSONHandler(&logs, nil)),
+		LogHeaders:   true,
+		LogBodies:    true,
+		RedactQuery:  []string{"api_key"},
+		RedactFields: []string{"token", "users.password", "card.number"},
+	}
+
+	var reply struct {
+		Token string `json:"token"`
+	}
+	body := map[string]interface{}{"card": map[string]string{"number": "4242424242424242", "brand": "visa"}}
+	if _, err := client.Post(context.Background(), "charges?api_key=key_123&page=2", body, &reply); err != nil {
+		test.Fatal(err)
+	}
+	if reply.Token != "tok_123" {
+		test.Errorf("expected the response body to reach the client unchanged but got %q", reply.Token)
+	}
+
+	entries := decodeLogs(test, &logs)
+	if len(entries) != 1 {
+		test.Fatalf("expected 1 log entry but got %d", len(entries))
+	}
+	entry := entries[0]
+	output, _ := json.Marshal(entry)
+	logged := string(output)
+	for _, secret := range []string{"secret-token", "key_123", "4242424242424242", "tok_123", "session=abc", `"one"`, `"two"`} {
+		if strings.Contains(logged, secret) {
+			test.Errorf("log leaks %q: %s", secret, logged)
+		}
+	}
+	if entry["method"] != "POST" || entry["status"] != float64(http.StatusOK) || entry["latency"] == nil {
+		test.Errorf("unexpected log entry %v", entry)
+	}
+	if !strings.Contains(entry["url"].(string), "page=2") || !strings.Contains(entry["request_body"].(string), "visa") {
+		test.Errorf("expected unredacted values to be logged: %v", entry)
+	}
+}
+
+func TestLoggingTransportTruncation(test *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		_, _ = responseWriter.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	testTools := Tools{}
+	httpClient := &http.Client{Transport: &LoggingTransport{Logger: slog.New(slog.NewJSONHandler(&logs, nil)), LogBodies: true, MaxBodySize: 10}}
+	remoteURI, _ := url.Parse(server.URL)
+	response, _, err := testTools.PostJSONToRemote(*remoteURI, map[string]string{"password": "hunter2"}, httpClient)
+	if err != nil {
+		test.Fatal(err)
+	}
+	var received bytes.Buffer
+	_, _ = received.ReadFrom(response.Body)
+	if received.Len() != 100 {
+		test.Errorf("expected the whole body to be returned but got %d bytes", received.Len())
+	}
+
+	entries := decodeLogs(test, &logs)
+	if entries[0]["response_body"] != "xxxxxxxxxx...[truncated]" {
+		test.Errorf("expected a truncated body but got %v", entries[0]["response_body"])
+	}
+
+	// a truncated body is left out when fields must be redacted
+	logs.Reset()
+	httpClient.Transport.(*LoggingTransport).RedactFields = []string{"password"}
+	_, _, _ = testTools.PostJSONToRemote(*remoteURI, map[string]string{"password": "hunter2"}, httpClient)
+	if strings.Contains(logs.String(), "hunter") {
+		test.Errorf("log leaks a truncated secret: %s", logs.String())
+	}
+}
+
+func TestLoggingTransportError(test *testing.T) {
+	var logs bytes.Buffer
+	httpClient := &http.Client{Transport: &LoggingTransport{Logger: slog.New(slog.NewJSONHandler(&logs, nil))}}
+	_, err := httpClient.Get("http://127.0.0.1:1/unreachable")
+	if err == nil {
+		test.Fatal("expected the request to fail")
+	}
+	entries := decodeLogs(test, &logs)
+	if len(entries) != 1 || entries[0]["level"] != "ERROR" || entries[0]["error"] == nil {
+		test.Errorf("expected an error log entry but got %v", entries)
+	}
+}
+
+func TestLoggingTransportUnredactable(test *testing.T) {
+	compressed := compressForTest(test, "gzip", []byte(`{"password":"hunter2"}`))
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/gzip" {
+			responseWriter.Header().Set("Content-Encoding", "gzip")
+			_, _ = responseWriter.Write(compressed)
+			return
+		}
+		_, _ = responseWriter.Write([]byte("password=hunter2"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"not JSON", "/form", "[body not logged: fields could not be redacted]"},
+		{"compressed", "/gzip", "[body not logged: gzip encoded]"},
+	}
+
+	for _, entry := range tests {
+		var logs bytes.Buffer
+		transport := &LoggingTransport{Logger: slog.New(slog.NewJSONHandler(&logs, nil)), LogBodies: true, RedactFields: []string{"password"}}
+		request, _ := http.NewRequest(http.MethodGet, server.URL+entry.path, nil)
+		// ask for the encoding, so the body is not decompressed before it is logged
+		request.Header.Set("Accept-Encoding", "gzip")
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			test.Fatal(err)
+		}
+		_ = response.Body.Close()
+
+		entries := decodeLogs(test, &logs)
+		if entries[0]["response_body"] != entry.expected {
+			test.Errorf("%s: expected %q but got %v", entry.name, entry.expected, entries[0]["response_body"])
+		}
+	}
+}
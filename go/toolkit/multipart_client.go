@@ -0,0 +1,288 @@
+package toolkit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MultipartFile is a file sent by PostMultipart
+// exactly one of Path, Reader or FS (with Path naming the file within it) supplies the content
+type MultipartFile struct {
+	// FieldName is the form field the file is sent as
+	FieldName string
+	// FileName is the file name sent to the server; the base name of Path when empty
+	FileName string
+	// ContentType is sent for the file; when empty it is guessed from the file name's extension,
+	// then from the first 512 bytes of content
+	ContentType string
+	// Path is a file on disk, or within FS
+	Path string
+	// FS, if set, is the file system Path is opened from
+	FS fs.FS
+	// Reader supplies the content when there is no Path; it is closed afterwards if it is an io.Closer
+	Reader io.Reader
+	// Size is the length of Reader, if known, for progress reports; files opened from a path are measured
+	Size int64
+}
+
+// FileFromPath sends the file at filePath as fieldName
+func FileFromPath(fieldName, filePath string) MultipartFile {
+	return MultipartFile{FieldName: fieldName, Path: filePath}
+}
+
+// FileFromFS sends the file called name in fsys as fieldName
+func FileFromFS(fieldName string, fsys fs.FS, name string) MultipartFile {
+	return MultipartFile{FieldName: fieldName, FS: fsys, Path: name}
+}
+
+// FileFromReader sends the content of reader as fieldName, named fileName
+func FileFromReader(fieldName, fileName string, reader io.Reader) MultipartFile {
+	return MultipartFile{FieldName: fieldName, FileName: fileName, Reader: reader, Size: -1}
+}
+
+// MultipartUpload is a multipart/form-data request body
+type MultipartUpload struct {
+	// Fields are text fields, sent before the files
+	Fields url.Values
+	// Files are sent in order after the fields
+	Files []MultipartFile
+	// Progress, if set, is called as file content is sent with the bytes sent so far and the total,
+	// which is -1 when the size of a file is not known
+	Progress func(sent, total int64)
+}
+
+// openedFile is a MultipartFile whose content is ready to be read
+type openedFile struct {
+	file   MultipartFile
+	name   string
+	reader io.Reader
+	closer io.Closer
+	size   int64
+}
+
+// open opens the content of every file, so a missing file is reported before anything is sent,
+// and returns the total size of the files or -1 when one is unknown
+func (upload *MultipartUpload) open() ([]openedFile, int64, error) {
+	var opened []openedFile
+	closeAll := func() {
+		for _, file := range opened {
+			if file.closer != nil {
+				_ = file.closer.Close()
+			}
+		}
+	}
+
+	total := int64(0)
+	for _, file := range upload.Files {
+		entry := openedFile{file: file, name: file.FileName, reader: file.Reader, size: file.Size}
+		switch {
+		case file.Path != "" && file.FS != nil:
+			content, err := file.FS.Open(file.Path)
+			if err != nil {
+				closeAll()
+				return nil, 0, err
+			}
+			entry.reader, entry.closer, entry.size = content, content, -1
+			if info, err := content.Stat(); err == nil {
+				entry.size = info.Size()
+			}
+			if entry.name == "" {
+				entry.name = path.Base(file.Path)
+			}
+		case file.Path != "":
+			content, err := os.Open(file.Path)
+			if err != nil {
+				closeAll()
+				return nil, 0, err
+			}
+			entry.reader, entry.closer, entry.size = content, content, -1
+			if info, err := content.Stat(); err == nil {
+				entry.size = info.Size()
+			}
+			if entry.name == "" {
+				entry.name = filepath.Base(file.Path)
+			}
+		case file.Reader != nil:
+			if closer, ok := file.Reader.(io.Closer); ok {
+				entry.closer = closer
+			}
+			if entry.size == 0 {
+				entry.size = -1
+			}
+		default:
+			closeAll()
+			return nil, 0, fmt.Errorf("multipart file for field %q has no content", file.FieldName)
+		}
+
+		opened = append(opened, entry)
+		if entry.size < 0 || total < 0 {
+			total = -1
+		} else {
+			total += entry.size
+		}
+	}
+	return opened, total, nil
+}
+
+// quoteEscaper escapes a form field or file name inside a quoted Content-Disposition parameter
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// write streams the upload to writer as multipart/form-data, closing the files as it goes
+func (upload *MultipartUpload) write(writer *multipart.Writer, files []openedFile, total int64) error {
+	defer func() {
+		for _, file := range files {
+			if file.closer != nil {
+				_ = file.closer.Close()
+			}
+		}
+	}()
+
+	keys := make([]string, 0, len(upload.Fields))
+	for key := range upload.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range upload.Fields[key] {
+			if err := writer.WriteField(key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	sent := int64(0)
+	for _, file := range files {
+		content := bufio.NewReaderSize(file.reader, 512)
+		contentType := file.file.ContentType
+		if contentType == "" {
+			contentType = typeByExtension(path.Ext(file.name))
+		}
+		if contentType == "" {
+			head, _ := content.Peek(512)
+			contentType = http.DetectContentType(head)
+		}
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, quoteEscaper.Replace(file.file.FieldName), quoteEscaper.Replace(file.name)))
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+
+		buffer := make([]byte, 32*1024)
+		for {
+			n, readErr := content.Read(buffer)
+			if n > 0 {
+				if _, err := part.Write(buffer[:n]); err != nil {
+					return err
+				}
+				sent += int64(n)
+				if upload.Progress != nil {
+					upload.Progress(sent, total)
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+	}
+	return writer.Close()
+}
+
+// newMultipartRequest builds a request which streams upload through a pipe, without buffering it
+func newMultipartRequest(ctx context.Context, target string, upload MultipartUpload) (*http.Request, error) {
+	files, total, err := upload.open()
+	if err != nil {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	writer := multipart.NewWriter(pipeWriter)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, pipeReader)
+	if err != nil {
+		for _, file := range files {
+			if file.closer != nil {
+				_ = file.closer.Close()
+			}
+		}
+		return nil, err
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	go func() {
+		// the transport closes the reader when the request ends, which stops this early if needed
+		pipeWriter.CloseWithError(upload.write(writer, files, total))
+	}()
+	return request, nil
+}
+
+// PostMultipart streams upload as a multipart/form-data POST to uri, for servers using UploadFiles
+// files are read as the request is sent rather than buffered, and ctx cancels the upload
+// it authenticates with RemoteTokenSource, fails fast while RemoteCircuitBreaker is open and limits
+// the response to MaxRemoteResponseSize as PostJSONToRemote does, but is never retried, since the
+// body can not be replayed
+// the returned response's body has already been read and closed, but can be read again
+func (tools *Tools) PostMultipart(ctx context.Context, uri url.URL, upload MultipartUpload, client ...*http.Client) (*http.Response, int, error) {
+	httpClient := &http.Client{}
+	if len(client) > 0 {
+		httpClient = client[0]
+	}
+
+	request, err := newMultipartRequest(ctx, uri.String(), upload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := sendWithToken(httpClient, request, tools.RemoteTokenSource, nil, tools.RemoteCircuitBreaker, nil)
+	if err != nil {
+		// the body is not read when no token could be had or the circuit is open, so close it to
+		// end the upload goroutine and close the files
+		_ = request.Body.Close()
+		return nil, 0, err
+	}
+	if _, err := readResponseBody(response, int64(tools.MaxRemoteResponseSize)); err != nil {
+		return nil, 0, newResponseError(response, err)
+	}
+	return response, response.StatusCode, nil
+}
+
+// PostMultipart streams upload as a multipart/form-data POST to path and decodes the reply into out,
+// as Do does for JSON bodies; the request is neither signed nor retried, since the body can not be replayed
+func (client *JSONClient) PostMultipart(ctx context.Context, path string, upload MultipartUpload, out interface{}) (*http.Response, error) {
+	target, err := client.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := newMultipartRequest(ctx, target, upload)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.prepare(request); err != nil {
+		// end the upload goroutine, which is waiting for the body to be read
+		_ = request.Body.Close()
+		return nil, err
+	}
+	response, err := client.send(request, nil, nil, out)
+	if err != nil {
+		// as the request may have failed before the body was read
+		_ = request.Body.Close()
+	}
+	return response, err
+}
@@ -0,0 +1,228 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+type receivedPart struct {
+	Field       string `json:"field"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+type receivedUpload struct {
+	Fields map[string][]string `json:"fields"`
+	Files  []receivedPart      `json:"files"`
+}
+
+// newMultipartServer answers each upload with the fields and files it received
+func newMultipartServer() *httptest.Server {
+	var testTools Tools
+	return httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		reader, err := request.MultipartReader()
+		if err != nil {
+			_ = testTools.ErrorJSON(responseWriter, err)
+			return
+		}
+		received := receivedUpload{Fields: map[string][]string{}}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = testTools.ErrorJSON(responseWriter, err)
+				return
+			}
+			data, _ := io.ReadAll(part)
+			if part.FileName() == "" {
+				received.Fields[part.FormName()] = append(received.Fields[part.FormName()], string(data))
+				continue
+			}
+			received.Files = append(received.Files, receivedPart{
+				Field:       part.FormName(),
+				FileName:    part.FileName(),
+				ContentType: part.Header.Get("Content-Type"),
+				Size:        len(data),
+			})
+		}
+		_ = testTools.WriteJSON(responseWriter, http.StatusOK, received)
+	}))
+}
+
+func TestJSONClient_PostMultipart(test *testing.T) {
+	server := newMultipartServer()
+	defer server.Close()
+	client, err := NewJSONClient(server.URL)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	image, err := os.Stat("./testdata/test_image.jpg")
+	if err != nil {
+		test.Fatal(err)
+	}
+	fsys := fstest.MapFS{"docs/notes.txt": {Data: []byte("some notes")}}
+
+	var sent, total int64
+	upload := MultipartUpload{
+		Fields: url.Values{"title": {"holiday"}, "tags": {"beach", "sun"}},
+		Files: []MultipartFile{
+			FileFromPath("photo", "./testdata/test_image.jpg"),
+			FileFromFS("notes", fsys, "docs/notes.txt"),
+			{FieldName: "data", FileName: "data", Reader: strings.NewReader("\x89PNG\r\n\x1a\n...."), Size: 12},
+		},
+		Progress: func(sentSoFar, totalSize int64) {
+			sent, total = sentSoFar, totalSize
+		},
+	}
+
+	var received receivedUpload
+	response, err := client.PostMultipart(context.Background(), "/upload", upload, &received)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		test.Errorf("wrong status: %d", response.StatusCode)
+	}
+
+	if strings.Join(received.Fields["tags"], ",") != "beach,sun" || received.Fields["title"][0] != "holiday" {
+		test.Errorf("wrong fields: %v", received.Fields)
+	}
+	expected := []receivedPart{
+		{Field: "photo", FileName: "test_image.jpg", ContentType: "image/jpeg", Size: int(image.Size())},
+		{Field: "notes", FileName: "notes.txt", ContentType: "text/plain; charset=utf-8", Size: 10},
+		{Field: "data", FileName: "data", ContentType: "image/png", Size: 12},
+	}
+	if len(received.Files) != len(expected) {
+		test.Fatalf("expected %d files, got %v", len(expected), received.Files)
+	}
+	for index, file := range expected {
+		if received.Files[index] != file {
+			test.Errorf("expected %+v, got %+v", file, received.Files[index])
+		}
+	}
+
+	wantTotal := image.Size() + 10 + 12
+	if sent != wantTotal || total != wantTotal {
+		test.Errorf("expected progress %d of %d, got %d of %d", wantTotal, wantTotal, sent, total)
+	}
+}
+
+func TestTools_PostMultipart(test *testing.T) {
+	server := newMultipartServer()
+	defer server.Close()
+	remoteURI, _ := url.Parse(server.URL)
+
+	var total int64
+	testTools := Tools{RemoteTokenSource: StaticBearerToken("secret")}
+	report := FileFromReader("file", "report.csv", strings.NewReader("a,b\n1,2\n"))
+	report.ContentType = "text/csv"
+	upload := MultipartUpload{
+		Files: []MultipartFile{report},
+		Progress: func(sent, totalSize int64) {
+			total = totalSize
+		},
+	}
+	response, status, err := testTools.PostMultipart(context.Background(), *remoteURI, upload)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if status != http.StatusOK {
+		test.Errorf("wrong status: %d", status)
+	}
+	if total != -1 {
+		test.Errorf("expected unknown total, got %d", total)
+	}
+
+	var received receivedUpload
+	if err := testTools.ReadRemoteJSON(response, &received); err != nil {
+		test.Fatal(err)
+	}
+	if len(received.Files) != 1 || received.Files[0].FileName != "report.csv" || received.Files[0].ContentType != "text/csv" {
+		test.Errorf("wrong files: %+v", received.Files)
+	}
+}
+
+func TestPostMultipart_Errors(test *testing.T) {
+	server := newMultipartServer()
+	defer server.Close()
+	client, err := NewJSONClient(server.URL)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// a missing file is reported before anything is sent
+	missing := MultipartUpload{Files: []MultipartFile{FileFromPath("file", "./testdata/missing.jpg")}}
+	if _, err := client.PostMultipart(context.Background(), "/upload", missing, nil); !errors.Is(err, fs.ErrNotExist) {
+		test.Errorf("expected not exist error, got %v", err)
+	}
+
+	empty := MultipartUpload{Files: []MultipartFile{{FieldName: "file"}}}
+	if _, err := client.PostMultipart(context.Background(), "/upload", empty, nil); err == nil {
+		test.Error("expected error for file without content")
+	}
+
+	// a cancelled context stops the upload
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	upload := MultipartUpload{Files: []MultipartFile{FileFromPath("file", "./testdata/test_image.jpg")}}
+	if _, err := client.PostMultipart(ctx, "/upload", upload, nil); !errors.Is(err, context.Canceled) {
+		test.Errorf("expected context canceled, got %v", err)
+	}
+}
+
+// closeRecorder reports when the upload closes it
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (recorder *closeRecorder) Close() error {
+	close(recorder.closed)
+	return nil
+}
+
+func TestPostMultipart_UnsentBodyClosed(test *testing.T) {
+	server := newMultipartServer()
+	defer server.Close()
+	remoteURI, _ := url.Parse(server.URL)
+
+	failing := &ClientCredentials{TokenURL: server.URL + "/missing"}
+	for name, post := range map[string]func(upload MultipartUpload) error{
+		"tools": func(upload MultipartUpload) error {
+			testTools := Tools{RemoteTokenSource: failing}
+			_, _, err := testTools.PostMultipart(context.Background(), *remoteURI, upload)
+			return err
+		},
+		"client": func(upload MultipartUpload) error {
+			client, _ := NewJSONClient(server.URL)
+			client.TokenSource = failing
+			_, err := client.PostMultipart(context.Background(), "/upload", upload, nil)
+			return err
+		},
+	} {
+		content := &closeRecorder{Reader: strings.NewReader("content"), closed: make(chan struct{})}
+		upload := MultipartUpload{Files: []MultipartFile{FileFromReader("file", "file.txt", content)}}
+		if err := post(upload); err == nil {
+			test.Errorf("%s: expected token error", name)
+		}
+		select {
+		case <-content.closed:
+		case <-time.After(5 * time.Second):
+			test.Errorf("%s: expected the unsent file to be closed", name)
+		}
+	}
+}
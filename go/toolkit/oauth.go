@@ -0,0 +1,307 @@
+package toolkit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default time before a cached token expires that ClientCredentials fetches a new one
+const defaultTokenRefreshBefore = time.Minute
+
+// Token is a credential sent in the Authorization header of remote calls
+type Token struct {
+	AccessToken string
+	// TokenType is the authorization scheme, Bearer when empty
+	TokenType string
+	// Expiry is when the token stops working; zero if it does not expire
+	Expiry time.Time
+}
+
+// SetAuthHeader sets the Authorization header of request to the token
+func (token Token) SetAuthHeader(request *http.Request) {
+	tokenType := token.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		// some servers send "bearer", but the scheme is conventionally capitalised
+		tokenType = "Bearer"
+	}
+	request.Header.Set("Authorization", tokenType+" "+token.AccessToken)
+}
+
+// TokenSource supplies the tokens JSONClient and PostJSONToRemote authenticate with
+// a source which caches tokens can also implement Invalidate, which is called when a remote rejects
+// a token with 401 Unauthorized, so the call is retried once with a new token
+type TokenSource interface {
+	Token(ctx context.Context) (Token, error)
+}
+
+// tokenInvalidator is implemented by token sources which can discard a rejected token
+type tokenInvalidator interface {
+	Invalidate(token Token)
+}
+
+// staticTokenSource always returns the same token
+type staticTokenSource struct {
+	token Token
+}
+
+func (source staticTokenSource) Token(ctx context.Context) (Token, error) {
+	return source.token, nil
+}
+
+// StaticBearerToken is a TokenSource which always sends token as a bearer token
+func StaticBearerToken(token string) TokenSource {
+	return staticTokenSource{token: Token{AccessToken: token, TokenType: "Bearer"}}
+}
+
+// StaticBasicAuth is a TokenSource which always sends username and password with HTTP basic authentication
+func StaticBasicAuth(username, password string) TokenSource {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return staticTokenSource{token: Token{AccessToken: credentials, TokenType: "Basic"}}
+}
+
+// OAuthError is returned when a token endpoint refuses to issue a token
+type OAuthError struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (oauthError *OAuthError) Error() string {
+	message := fmt.Sprintf("token request failed with status %d", oauthError.StatusCode)
+	if oauthError.Code != "" {
+		message += ": " + oauthError.Code
+	}
+	if oauthError.Description != "" {
+		message += ": " + oauthError.Description
+	}
+	return message
+}
+
+// ClientCredentials is a TokenSource using the OAuth2 client credentials grant (RFC 6749 section 4.4)
+// tokens are cached and fetched again RefreshBefore their expiry, or when a remote rejects one
+// it is safe for concurrent use; concurrent callers share a single token request, which carries on
+// when one of them gives up, and no lock is held while it is sent
+type ClientCredentials struct {
+	// TokenURL is the token endpoint of the authorization server
+	TokenURL string
+	// ClientID and ClientSecret identify the client, sent with HTTP basic authentication
+	ClientID     string
+	ClientSecret string
+	// SendCredentialsInBody sends the client ID and secret as form parameters instead, for servers
+	// which do not support basic authentication at the token endpoint
+	SendCredentialsInBody bool
+	// Scopes are requested for the token, if any
+	Scopes []string
+	// EndpointParams are further form parameters for the token request, such as audience
+	EndpointParams url.Values
+	// RefreshBefore is how long before expiry a new token is fetched; 1 minute when zero
+	// it is cut to half the token's lifetime for tokens which live no longer than twice that,
+	// so a short lived token is still used rather than fetched again on every call
+	RefreshBefore time.Duration
+	// HTTPClient sends the token requests; a client with a 30 second timeout when nil
+	HTTPClient *http.Client
+
+	mutex    sync.Mutex
+	token    Token
+	obtained time.Time
+	pending  *tokenFetch
+	now      func() time.Time
+}
+
+// tokenFetch is a token request shared by every caller waiting for it
+type tokenFetch struct {
+	done  chan struct{}
+	token Token
+	err   error
+}
+
+// Token returns the cached token, fetching a new one when there is none or it is about to expire
+func (credentials *ClientCredentials) Token(ctx context.Context) (Token, error) {
+	credentials.mutex.Lock()
+	if credentials.fresh() {
+		token := credentials.token
+		credentials.mutex.Unlock()
+		return token, nil
+	}
+	fetch := credentials.pending
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		credentials.pending = fetch
+		go credentials.refresh(ctx, fetch)
+	}
+	credentials.mutex.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.token, fetch.err
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	}
+}
+
+// fresh reports whether the cached token can still be used; the mutex must be held
+func (credentials *ClientCredentials) fresh() bool {
+	if credentials.token.AccessToken == "" {
+		return false
+	}
+	if credentials.token.Expiry.IsZero() {
+		return true
+	}
+
+	refreshBefore := credentials.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = defaultTokenRefreshBefore
+	}
+	refreshBefore = min(refreshBefore, credentials.token.Expiry.Sub(credentials.obtained)/2)
+	return credentials.clock().Add(refreshBefore).Before(credentials.token.Expiry)
+}
+
+// refresh runs fetch and caches its token
+// the request is detached from the cancellation of ctx, as other callers may be waiting for it;
+// the HTTPClient's timeout still bounds it
+func (credentials *ClientCredentials) refresh(ctx context.Context, fetch *tokenFetch) {
+	obtained := credentials.clock()
+	token, err := credentials.fetch(context.WithoutCancel(ctx))
+
+	credentials.mutex.Lock()
+	if err == nil {
+		credentials.token, credentials.obtained = token, obtained
+	}
+	credentials.pending = nil
+	credentials.mutex.Unlock()
+
+	fetch.token, fetch.err = token, err
+	close(fetch.done)
+}
+
+func (credentials *ClientCredentials) clock() time.Time {
+	if credentials.now != nil {
+		return credentials.now()
+	}
+	return time.Now()
+}
+
+// Invalidate discards the cached token if it is still token, so the next call fetches a new one
+func (credentials *ClientCredentials) Invalidate(token Token) {
+	credentials.mutex.Lock()
+	defer credentials.mutex.Unlock()
+
+	if credentials.token.AccessToken == token.AccessToken {
+		credentials.token = Token{}
+	}
+}
+
+// fetch requests a new token from the token endpoint
+func (credentials *ClientCredentials) fetch(ctx context.Context) (Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(credentials.Scopes) > 0 {
+		form.Set("scope", strings.Join(credentials.Scopes, " "))
+	}
+	for key, values := range credentials.EndpointParams {
+		form[key] = values
+	}
+	if credentials.SendCredentialsInBody {
+		form.Set("client_id", credentials.ClientID)
+		form.Set("client_secret", credentials.ClientSecret)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, credentials.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if !credentials.SendCredentialsInBody {
+		request.SetBasicAuth(url.QueryEscape(credentials.ClientID), url.QueryEscape(credentials.ClientSecret))
+	}
+
+	httpClient := credentials.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultClientTimeout}
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return Token{}, err
+	}
+	responseBody, err := readResponseBody(response, megabyte)
+	if err != nil {
+		return Token{}, newResponseError(response, err)
+	}
+
+	var reply struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	decodeErr := json.Unmarshal(responseBody, &reply)
+	if response.StatusCode != http.StatusOK || reply.Error != "" {
+		return Token{}, &OAuthError{StatusCode: response.StatusCode, Code: reply.Error, Description: reply.ErrorDescription}
+	}
+	if decodeErr != nil {
+		return Token{}, newResponseError(response, decodeErr)
+	}
+	if reply.AccessToken == "" {
+		return Token{}, &OAuthError{StatusCode: response.StatusCode, Description: "token response has no access_token"}
+	}
+
+	token := Token{AccessToken: reply.AccessToken, TokenType: reply.TokenType}
+	if reply.ExpiresIn > 0 {
+		token.Expiry = credentials.clock().Add(time.Duration(reply.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// sendWithToken authenticates request with a token from source, then sends it, signed by signer if
+// there is one, with sendWithRetry
+// when the remote answers 401 Unauthorized and source can invalidate tokens, the request is sent
+// once more with a new token
+func sendWithToken(httpClient *http.Client, request *http.Request, source TokenSource, policy *RetryPolicy, breaker *CircuitBreaker, signer *WebhookSigner) (*http.Response, error) {
+	if source == nil {
+		return sendWithRetry(httpClient, request, policy, breaker, signer)
+	}
+
+	ctx := request.Context()
+	token, err := source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(request)
+
+	response, err := sendWithRetry(httpClient, request, policy, breaker, signer)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	invalidator, ok := source.(tokenInvalidator)
+	if !ok || (request.Body != nil && request.Body != http.NoBody && request.GetBody == nil) {
+		return response, nil
+	}
+
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, megabyte))
+	_ = response.Body.Close()
+
+	invalidator.Invalidate(token)
+	token, err = source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := request.Clone(ctx)
+	if request.GetBody != nil {
+		if retry.Body, err = request.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	token.SetAuthHeader(retry)
+	return sendWithRetry(httpClient, retry, policy, breaker, signer)
+}
@@ -0,0 +1,226 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// oauthServer is a token endpoint and an API which accepts only the latest token it issued
+type oauthServer struct {
+	expiresIn int
+	issued    atomic.Int32
+	current   atomic.Value
+	apiCalls  atomic.Int32
+}
+
+func (server *oauthServer) handler(test *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(responseWriter http.ResponseWriter, request *http.Request) {
+		clientID, clientSecret, ok := request.BasicAuth()
+		if request.FormValue("client_id") != "" {
+			clientID, clientSecret, ok = request.FormValue("client_id"), request.FormValue("client_secret"), true
+		}
+		responseWriter.Header().Set("Content-Type", "application/json")
+		if !ok || clientID != "client" || clientSecret != "s3cret" || request.FormValue("grant_type") != "client_credentials" {
+			responseWriter.WriteHeader(http.StatusUnauthorized)
+			_, _ = responseWriter.Write([]byte(`{"error":"invalid_client","error_description":"unknown client"}`))
+			return
+		}
+		if request.FormValue("scope") != "read write" || request.FormValue("audience") != "api" {
+			test.Errorf("unexpected token request parameters %v", request.Form)
+		}
+		token := fmt.Sprintf("tok-%d", server.issued.Add(1))
+		server.current.Store(token)
+		_, _ = fmt.Fprintf(responseWriter, `{"access_token":%q,"token_type":"bearer","expires_in":%d}`, token, server.expiresIn)
+	})
+	mux.HandleFunc("/api", func(responseWriter http.ResponseWriter, request *http.Request) {
+		server.apiCalls.Add(1)
+		if request.Header.Get("Authorization") != fmt.Sprintf("Bearer %v", server.current.Load()) {
+			responseWriter.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		responseWriter.Header().Set("Content-Type", "application/json")
+		_, _ = responseWriter.Write([]byte(`{"ok":true}`))
+	})
+	return mux
+}
+
+func newClientCredentials(tokenURL string) *ClientCredentials {
+	return &ClientCredentials{
+		TokenURL:       tokenURL,
+		ClientID:       "client",
+		ClientSecret:   "s3cret",
+		Scopes:         []string{"read", "write"},
+		EndpointParams: url.Values{"audience": {"api"}},
+	}
+}
+
+func TestClientCredentials(test *testing.T) {
+	oauth := &oauthServer{expiresIn: 3600}
+	server := httptest.NewServer(oauth.handler(test))
+	defer server.Close()
+
+	credentials := newClientCredentials(server.URL + "/token")
+	client, _ := NewJSONClient(server.URL)
+	client.TokenSource = credentials
+
+	// concurrent calls share one cached token
+	var wait sync.WaitGroup
+	for idx := 0; idx < 10; idx++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := client.Get(context.Background(), "api", nil); err != nil {
+				test.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	if oauth.issued.Load() != 1 {
+		test.Errorf("expected one token to be issued but %d were", oauth.issued.Load())
+	}
+
+	// a revoked token is replaced and the call retried once
+	oauth.current.Store("revoked")
+	if _, err := client.Get(context.Background(), "api", nil); err != nil {
+		test.Errorf("expected the call to be retried with a new token but got %v", err)
+	}
+	if oauth.issued.Load() != 2 {
+		test.Errorf("expected a second token to be issued but %d were", oauth.issued.Load())
+	}
+
+	credentials.SendCredentialsInBody = true
+	credentials.Invalidate(Token{AccessToken: "tok-2"})
+	if token, err := credentials.Token(context.Background()); err != nil || token.AccessToken != "tok-3" {
+		test.Errorf("expected a new token sent with credentials in the body but got %v, %v", token, err)
+	}
+}
+
+func TestClientCredentialsRefresh(test *testing.T) {
+	oauth := &oauthServer{expiresIn: 30}
+	server := httptest.NewServer(oauth.handler(test))
+	defer server.Close()
+
+	clock := &testClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	credentials := newClientCredentials(server.URL + "/token")
+	credentials.now = clock.now
+
+	// a token living less than RefreshBefore is still used for half its lifetime
+	for idx := 0; idx < 2; idx++ {
+		if _, err := credentials.Token(context.Background()); err != nil {
+			test.Fatal(err)
+		}
+	}
+	if oauth.issued.Load() != 1 {
+		test.Errorf("expected a short lived token to be reused, but %d were issued", oauth.issued.Load())
+	}
+	clock.current = clock.current.Add(16 * time.Second)
+	_, _ = credentials.Token(context.Background())
+	if oauth.issued.Load() != 2 {
+		test.Errorf("expected a token past half its lifetime to be refreshed, but %d were issued", oauth.issued.Load())
+	}
+
+	// a token expiring within RefreshBefore is fetched again
+	credentials.RefreshBefore = 10 * time.Second
+	clock.current = clock.current.Add(19 * time.Second)
+	_, _ = credentials.Token(context.Background())
+	if oauth.issued.Load() != 2 {
+		test.Errorf("expected the cached token to be used, but %d were issued", oauth.issued.Load())
+	}
+	clock.current = clock.current.Add(2 * time.Second)
+	_, _ = credentials.Token(context.Background())
+	if oauth.issued.Load() != 3 {
+		test.Errorf("expected a token expiring within RefreshBefore to be refreshed, but %d were issued", oauth.issued.Load())
+	}
+
+	credentials.ClientSecret = "wrong"
+	credentials.Invalidate(Token{AccessToken: "tok-3"})
+	_, err := credentials.Token(context.Background())
+	var oauthError *OAuthError
+	if !errors.As(err, &oauthError) || oauthError.Code != "invalid_client" || oauthError.StatusCode != http.StatusUnauthorized {
+		test.Errorf("expected an OAuthError but got %v", err)
+	}
+}
+
+func TestClientCredentialsCancelledCaller(test *testing.T) {
+	release := make(chan struct{})
+	var issued atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		<-release
+		responseWriter.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(responseWriter, `{"access_token":"tok-%d","token_type":"bearer","expires_in":3600}`, issued.Add(1))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	credentials := &ClientCredentials{TokenURL: server.URL, ClientID: "client", ClientSecret: "s3cret"}
+
+	// a caller giving up does not fail the request others are waiting for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := credentials.Token(ctx)
+		cancelled <- err
+	}()
+	waiting := make(chan Token, 1)
+	go func() {
+		token, _ := credentials.Token(context.Background())
+		waiting <- token
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		test.Errorf("expected the cancelled caller to return at once but got %v", err)
+	}
+	release <- struct{}{}
+	if token := <-waiting; token.AccessToken != "tok-1" {
+		test.Errorf("expected the shared token but got %v", token)
+	}
+	if issued.Load() != 1 {
+		test.Errorf("expected one token request but %d were made", issued.Load())
+	}
+}
+
+func TestTools_PostJSONToRemoteTokenSource(test *testing.T) {
+	oauth := &oauthServer{expiresIn: 3600}
+	server := httptest.NewServer(oauth.handler(test))
+	defer server.Close()
+	remoteURI, _ := url.Parse(server.URL + "/api")
+
+	testTools := Tools{RemoteTokenSource: newClientCredentials(server.URL + "/token")}
+	oauth.current.Store("stale")
+	if _, status, err := testTools.PostJSONToRemote(*remoteURI, map[string]int{"id": 1}); err != nil || status != http.StatusOK {
+		test.Errorf("expected the call to succeed with a fresh token but got %d, %v", status, err)
+	}
+
+	// static sources can not be refreshed, so the 401 is returned after one call
+	oauth.apiCalls.Store(0)
+	testTools.RemoteTokenSource = StaticBearerToken("stale")
+	if _, status, _ := testTools.PostJSONToRemote(*remoteURI, nil); status != http.StatusUnauthorized || oauth.apiCalls.Load() != 1 {
+		test.Errorf("expected a single rejected call but got %d after %d calls", status, oauth.apiCalls.Load())
+	}
+}
+
+func TestStaticTokenSources(test *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	token, _ := StaticBasicAuth("user", "pass").Token(context.Background())
+	token.SetAuthHeader(request)
+	if username, password, ok := request.BasicAuth(); !ok || username != "user" || password != "pass" {
+		test.Errorf("unexpected basic auth header %q", request.Header.Get("Authorization"))
+	}
+
+	token, _ = StaticBearerToken("abc").Token(context.Background())
+	token.SetAuthHeader(request)
+	if request.Header.Get("Authorization") != "Bearer abc" {
+		test.Errorf("unexpected bearer header %q", request.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,220 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ProblemDetails is an RFC 7807 problem document
+// Extensions are written as additional top level members
+// it is also an error, so handlers can return one to control exactly what ProblemJSON sends
+type ProblemDetails struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+}
+
+func (problem *ProblemDetails) Error() string {
+	if problem.Detail != "" {
+		return problem.Detail
+	}
+	return problem.Title
+}
+
+// StatusCode is the HTTP status ErrorJSON uses for the problem when none is given
+func (problem *ProblemDetails) StatusCode() int {
+	if problem.Status == 0 {
+		return http.StatusBadRequest
+	}
+	return problem.Status
+}
+
+// problemMembers are the names RFC 7807 reserves, which extensions can not replace
+var problemMembers = map[string]bool{"type": true, "title": true, "status": true, "detail": true, "instance": true}
+
+// MarshalJSON flattens the extension members alongside the standard ones
+func (problem ProblemDetails) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(problem.Extensions)+5)
+	for key, value := range problem.Extensions {
+		if !problemMembers[key] {
+			members[key] = value
+		}
+	}
+
+	members["type"] = problem.Type
+	if problem.Type == "" {
+		members["type"] = "about:blank"
+	}
+	if problem.Title != "" {
+		members["title"] = problem.Title
+	}
+	if problem.Status != 0 {
+		members["status"] = problem.Status
+	}
+	if problem.Detail != "" {
+		members["detail"] = problem.Detail
+	}
+	if problem.Instance != "" {
+		members["instance"] = problem.Instance
+	}
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON reads a problem document, collecting unknown members into Extensions
+func (problem *ProblemDetails) UnmarshalJSON(data []byte) error {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+
+	*problem = ProblemDetails{}
+	for key, value := range members {
+		var err error
+		switch key {
+		case "type":
+			err = json.Unmarshal(value, &problem.Type)
+		case "title":
+			err = json.Unmarshal(value, &problem.Title)
+		case "status":
+			err = json.Unmarshal(value, &problem.Status)
+		case "detail":
+			err = json.Unmarshal(value, &problem.Detail)
+		case "instance":
+			err = json.Unmarshal(value, &problem.Instance)
+		default:
+			if problem.Extensions == nil {
+				problem.Extensions = make(map[string]interface{})
+			}
+			var extension interface{}
+			err = json.Unmarshal(value, &extension)
+			problem.Extensions[key] = extension
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProblemJSON takes an error and optionally a status code
+// generates and sends an application/problem+json response as described by RFC 7807
+// a *ProblemDetails error is sent as is; the toolkit's typed errors (JSONError, JSONStreamError,
+// ValidationErrors) become problems whose type is ProblemTypeBaseURI followed by the kind of error,
+// with their details as extension members; any other error is sent with its message as the detail
+// registered error mappings and the masking of unknown errors apply as they do for ErrorJSON, with the code
+// sent as a "code" extension member, and the request ID is sent as a "request_id" extension member
+func (tools *Tools) ProblemJSON(responseWriter http.ResponseWriter, err error, status ...int) error {
+	return tools.ProblemJSONForRequest(responseWriter, nil, err, status...)
+}
+
+// ProblemJSONForRequest is ProblemJSON taking the request ID and logging context from request,
+// as ErrorJSONForRequest does
+func (tools *Tools) ProblemJSONForRequest(responseWriter http.ResponseWriter, request *http.Request, err error, status ...int) error {
+	resolved := tools.resolveError(err, status...)
+	requestID := tools.errorRequestID(responseWriter, request)
+	tools.logError(request, err, resolved.status, requestID)
+
+	var problem ProblemDetails
+	if resolved.masked {
+		problem = ProblemDetails{Title: http.StatusText(resolved.status), Status: resolved.status, Detail: resolved.message}
+	} else {
+		problem = tools.problemFor(err, resolved.status)
+		if resolved.message != err.Error() {
+			problem.Detail = resolved.message
+		}
+	}
+
+	extensions := map[string]interface{}{"request_id": requestID}
+	if resolved.code != "" {
+		extensions["code"] = resolved.code
+	}
+	for key, value := range problem.Extensions {
+		extensions[key] = value
+	}
+	problem.Extensions = extensions
+	return tools.writeJSONAs(responseWriter, problem.Status, problem, "application/problem+json")
+}
+
+// problemFor derives the problem document describing err
+func (tools *Tools) problemFor(err error, status int) ProblemDetails {
+	var supplied *ProblemDetails
+	if errors.As(err, &supplied) {
+		problem := *supplied
+		problem.Status = status
+		if problem.Title == "" && (problem.Type == "" || problem.Type == "about:blank") {
+			problem.Title = http.StatusText(status)
+		}
+		return problem
+	}
+
+	problem := ProblemDetails{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+	}
+
+	var streamError *JSONStreamError
+	var validationErrors ValidationErrors
+	var jsonError *JSONError
+	switch {
+	case errors.As(err, &streamError):
+		inner := tools.problemFor(streamError.Err, status)
+		problem.Type, problem.Title = inner.Type, inner.Title
+		problem.Extensions = map[string]interface{}{"index": streamError.Index}
+		for key, value := range inner.Extensions {
+			problem.Extensions[key] = value
+		}
+	case errors.As(err, &validationErrors):
+		problem.Type = tools.problemType("validation")
+		if problem.Type != "" {
+			// about:blank problems must use the status text as their title
+			problem.Title = "Validation failed"
+		}
+		problem.Extensions = map[string]interface{}{"errors": validationErrors}
+	case errors.As(err, &jsonError):
+		problem.Type = tools.problemType(string(jsonError.Kind))
+		problem.Extensions = jsonErrorExtensions(jsonError)
+	}
+	return problem
+}
+
+// problemType builds a problem type URI, or leaves it empty for about:blank when no base is configured
+func (tools *Tools) problemType(kind string) string {
+	if tools.ProblemTypeBaseURI == "" {
+		return ""
+	}
+	if !strings.HasSuffix(tools.ProblemTypeBaseURI, "/") {
+		return tools.ProblemTypeBaseURI + "/" + kind
+	}
+	return tools.ProblemTypeBaseURI + kind
+}
+
+// jsonErrorExtensions lists the populated fields of a JSONError as problem extension members
+func jsonErrorExtensions(jsonError *JSONError) map[string]interface{} {
+	extensions := map[string]interface{}{"kind": jsonError.Kind}
+	if jsonError.Field != "" {
+		extensions["field"] = jsonError.Field
+	}
+	if jsonError.Offset != 0 {
+		extensions["offset"] = jsonError.Offset
+	}
+	if jsonError.Line != 0 {
+		extensions["line"] = jsonError.Line
+		extensions["column"] = jsonError.Column
+	}
+	if jsonError.Expected != "" {
+		extensions["expected"] = jsonError.Expected
+	}
+	if jsonError.Actual != "" {
+		extensions["actual"] = jsonError.Actual
+	}
+	if jsonError.Limit != 0 {
+		extensions["limit"] = jsonError.Limit
+	}
+	return extensions
+}
@@ -0,0 +1,121 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var problemTests = []struct {
+	name             string
+	tools            Tools
+	err              error
+	status           []int
+	expectedStatus   int
+	expectedType     string
+	expectedTitle    string
+	expectedDetail   string
+	expectedInstance string
+	expectedMembers  []string
+}{
+	{name: "plain error", err: errors.New("some error"), expectedStatus: http.StatusInternalServerError, expectedType: "about:blank", expectedTitle: "Internal Server Error", expectedDetail: "internal server error"},
+	{name: "exposed error", tools: Tools{ExposeUnknownErrors: true}, err: errors.New("some error"), expectedStatus: http.StatusBadRequest, expectedType: "about:blank", expectedTitle: "Bad Request", expectedDetail: "some error"},
+	{name: "explicit status", err: errors.New("some error"), status: []int{http.StatusServiceUnavailable}, expectedStatus: http.StatusServiceUnavailable, expectedType: "about:blank", expectedTitle: "Service Unavailable", expectedDetail: "internal server error"},
+	{name: "explicit client status", err: errors.New("some error"), status: []int{http.StatusConflict}, expectedStatus: http.StatusConflict, expectedType: "about:blank", expectedTitle: "Conflict", expectedDetail: "some error"},
+	{
+		name:            "json error",
+		tools:           Tools{ProblemTypeBaseURI: "https://example.com/problems"},
+		err:             &JSONError{Kind: JSONErrorTooLarge, Message: "body must not be larger than 8 bytes", Limit: 8},
+		expectedStatus:  http.StatusRequestEntityTooLarge,
+		expectedType:    "https://example.com/problems/too_large",
+		expectedTitle:   "Request Entity Too Large",
+		expectedDetail:  "body must not be larger than 8 bytes",
+		expectedMembers: []string{"kind", "limit"},
+	},
+	{
+		name:            "validation errors",
+		tools:           Tools{ProblemTypeBaseURI: "https://example.com/problems/"},
+		err:             ValidationErrors{{Field: "name", Rule: "required", Message: "name is required"}},
+		expectedStatus:  http.StatusUnprocessableEntity,
+		expectedType:    "https://example.com/problems/validation",
+		expectedTitle:   "Validation failed",
+		expectedDetail:  "validation failed: name is required",
+		expectedMembers: []string{"errors"},
+	},
+	{
+		name:            "stream error without base uri",
+		err:             &JSONStreamError{Index: 4, Err: &JSONError{Kind: JSONErrorType, Message: "bad type", Field: "id"}},
+		expectedStatus:  http.StatusBadRequest,
+		expectedType:    "about:blank",
+		expectedTitle:   "Bad Request",
+		expectedDetail:  "item 4: bad type",
+		expectedMembers: []string{"index", "kind", "field"},
+	},
+	{
+		name:             "supplied problem",
+		err:              &ProblemDetails{Type: "https://example.com/problems/out-of-credit", Title: "You do not have enough credit.", Status: http.StatusForbidden, Detail: "Your balance is 30, but that costs 50.", Instance: "/account/12345/msgs/abc", Extensions: map[string]interface{}{"balance": 30, "status": "ignored"}},
+		expectedStatus:   http.StatusForbidden,
+		expectedType:     "https://example.com/problems/out-of-credit",
+		expectedTitle:    "You do not have enough credit.",
+		expectedDetail:   "Your balance is 30, but that costs 50.",
+		expectedInstance: "/account/12345/msgs/abc",
+		expectedMembers:  []string{"balance"},
+	},
+}
+
+func TestTools_ProblemJSON(test *testing.T) {
+	for _, entry := range problemTests {
+		responseRecorder := httptest.NewRecorder()
+		err := entry.tools.ProblemJSON(responseRecorder, entry.err, entry.status...)
+		if err != nil {
+			test.Errorf("%s: %v", entry.name, err)
+			continue
+		}
+
+		if responseRecorder.Code != entry.expectedStatus {
+			test.Errorf("%s: expected status %d but got %d", entry.name, entry.expectedStatus, responseRecorder.Code)
+		}
+		if responseRecorder.Header().Get("Content-Type") != "application/problem+json" {
+			test.Errorf("%s: wrong content type %s", entry.name, responseRecorder.Header().Get("Content-Type"))
+		}
+
+		var problem ProblemDetails
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&problem); err != nil {
+			test.Errorf("%s: received error when decoding JSON: %v", entry.name, err)
+			continue
+		}
+		if problem.Type != entry.expectedType || problem.Title != entry.expectedTitle || problem.Detail != entry.expectedDetail || problem.Instance != entry.expectedInstance {
+			test.Errorf("%s: unexpected problem %+v", entry.name, problem)
+		}
+		if problem.Status != entry.expectedStatus {
+			test.Errorf("%s: expected status member %d but got %d", entry.name, entry.expectedStatus, problem.Status)
+		}
+		if problem.Extensions["request_id"] != responseRecorder.Header().Get(DefaultRequestIDHeader) {
+			test.Errorf("%s: expected the request id from the header but got %v", entry.name, problem.Extensions["request_id"])
+		}
+		delete(problem.Extensions, "request_id")
+		if len(problem.Extensions) != len(entry.expectedMembers) {
+			test.Errorf("%s: expected extensions %v but got %v", entry.name, entry.expectedMembers, problem.Extensions)
+		}
+		for _, member := range entry.expectedMembers {
+			if _, ok := problem.Extensions[member]; !ok {
+				test.Errorf("%s: extension %s missing", entry.name, member)
+			}
+		}
+	}
+}
+
+func TestTools_ErrorJSONUseProblemJSON(test *testing.T) {
+	testTools := Tools{UseProblemJSON: true}
+	responseRecorder := httptest.NewRecorder()
+
+	err := testTools.ErrorJSON(responseRecorder, errors.New("some error"), http.StatusConflict)
+	if err != nil {
+		test.Error(err)
+	}
+	if responseRecorder.Code != http.StatusConflict || responseRecorder.Header().Get("Content-Type") != "application/problem+json" {
+		test.Errorf("expected a 409 problem but got %d %s", responseRecorder.Code, responseRecorder.Header().Get("Content-Type"))
+	}
+}
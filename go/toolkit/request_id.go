@@ -0,0 +1,124 @@
+package toolkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the header request IDs are read from and sent in when RequestIDHeader is empty
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest incoming request ID that is trusted; longer ones are replaced
+const maxRequestIDLength = 128
+
+// requestIDBytes is the number of random bytes in generated request IDs, which are hex encoded
+const requestIDBytes = 10
+
+// requestIDKey is the context key the RequestID middleware stores the ID under
+type requestIDKey struct{}
+
+// requestIDHeader is the configured request ID header, or DefaultRequestIDHeader
+func (tools *Tools) requestIDHeader() string {
+	if tools.RequestIDHeader == "" {
+		return DefaultRequestIDHeader
+	}
+	return tools.RequestIDHeader
+}
+
+// RequestID is middleware which gives every request an ID
+// the ID is read from the RequestIDHeader (default X-Request-ID) of the incoming request, or generated
+// from crypto/rand when it is missing or not a short printable string, then echoed in the same
+// response header and stored on the request context, where RequestIDFromContext finds it
+// ErrorJSON and ProblemJSON include it in error responses and logs
+func (tools *Tools) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		header := tools.requestIDHeader()
+		requestID := request.Header.Get(header)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		responseWriter.Header().Set(header, requestID)
+		ctx := context.WithValue(request.Context(), requestIDKey{}, requestID)
+		next.ServeHTTP(responseWriter, request.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext returns the ID the RequestID middleware gave a request, or an empty string
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// newRequestID generates a request ID of 20 hex characters
+// it reads crypto/rand directly, as RandomString is too slow to call on every request
+func newRequestID() string {
+	requestID := make([]byte, requestIDBytes)
+	_, _ = rand.Read(requestID)
+	return hex.EncodeToString(requestID)
+}
+
+// validRequestID reports whether an incoming request ID is safe to echo back and log
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for idx := 0; idx < len(requestID); idx++ {
+		if requestID[idx] < 0x21 || requestID[idx] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// errorRequestID returns the request ID already set on the response, by the RequestID middleware
+// for example, or that of request, which may be nil, from its context or its RequestIDHeader when
+// that is valid; failing those it generates one, and sets it on the response so the client can quote it
+func (tools *Tools) errorRequestID(responseWriter http.ResponseWriter, request *http.Request) string {
+	header := tools.requestIDHeader()
+	requestID := responseWriter.Header().Get(header)
+	if requestID != "" {
+		return requestID
+	}
+
+	if request != nil {
+		requestID = RequestIDFromContext(request.Context())
+		if incoming := request.Header.Get(header); requestID == "" && validRequestID(incoming) {
+			requestID = incoming
+		}
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	responseWriter.Header().Set(header, requestID)
+	return requestID
+}
+
+// logError logs the full error sent to a client, if a Logger is set, with the context of request
+// if there is one, so handlers can add attributes from it
+// 5xx responses are logged at error level, 4xx at warn level and anything else at info level
+func (tools *Tools) logError(request *http.Request, err error, status int, requestID string) {
+	if tools.Logger == nil {
+		return
+	}
+	ctx := context.Background()
+	if request != nil {
+		ctx = request.Context()
+	}
+
+	level := slog.LevelInfo
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= http.StatusBadRequest:
+		level = slog.LevelWarn
+	}
+	tools.Logger.LogAttrs(ctx, level, "error response",
+		slog.String("request_id", requestID),
+		slog.Int("status", status),
+		slog.String("error", err.Error()),
+	)
+}
@@ -0,0 +1,137 @@
+package toolkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var requestIDTests = []struct {
+	name       string
+	incoming   string
+	expectSame bool
+}{
+	{name: "incoming id", incoming: "abc-123", expectSame: true},
+	{name: "missing id", incoming: ""},
+	{name: "id with spaces", incoming: "abc 123"},
+	{name: "id too long", incoming: strings.Repeat("a", 200)},
+}
+
+func TestTools_RequestID(test *testing.T) {
+	for _, entry := range requestIDTests {
+		var testTools Tools
+		var fromContext string
+		handler := testTools.RequestID(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			fromContext = RequestIDFromContext(request.Context())
+			_ = testTools.ErrorJSON(responseWriter, errors.New("some error"))
+		}))
+
+		request := httptest.NewRequest("GET", "/", nil)
+		if entry.incoming != "" {
+			request.Header.Set("X-Request-ID", entry.incoming)
+		}
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+
+		var payload JSONResponse
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&payload); err != nil {
+			test.Fatalf("%s: %v", entry.name, err)
+		}
+		headerID := responseRecorder.Header().Get("X-Request-ID")
+		if headerID == "" || headerID != fromContext || headerID != payload.RequestID {
+			test.Errorf("%s: request ids differ: header %q, context %q, payload %q", entry.name, headerID, fromContext, payload.RequestID)
+		}
+		if (headerID == entry.incoming) != entry.expectSame {
+			test.Errorf("%s: unexpected request id %q", entry.name, headerID)
+		}
+	}
+}
+
+func TestTools_ErrorJSONLogging(test *testing.T) {
+	var logs bytes.Buffer
+	testTools := Tools{Logger: slog.New(slog.NewJSONHandler(&logs, nil)), RequestIDHeader: "X-Correlation-ID"}
+
+	responseRecorder := httptest.NewRecorder()
+	responseRecorder.Header().Set("X-Correlation-ID", "corr-1")
+	_ = testTools.ErrorJSON(responseRecorder, errors.New("open /srv/secret: permission denied"))
+	_ = testTools.ErrorJSON(httptest.NewRecorder(), errors.New("bad input"), http.StatusBadRequest)
+
+	var entries []map[string]interface{}
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			test.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		test.Fatalf("expected 2 log entries but got %d", len(entries))
+	}
+	if entries[0]["level"] != "ERROR" || entries[0]["request_id"] != "corr-1" || entries[0]["error"] != "open /srv/secret: permission denied" {
+		test.Errorf("unexpected log entry %v", entries[0])
+	}
+	if entries[1]["level"] != "WARN" || entries[1]["status"] != float64(http.StatusBadRequest) {
+		test.Errorf("unexpected log entry %v", entries[1])
+	}
+	if strings.Contains(responseRecorder.Body.String(), "/srv/secret") {
+		test.Errorf("response leaks the error: %s", responseRecorder.Body.String())
+	}
+}
+
+// contextRecorder is a slog.Handler which keeps the context of each record
+type contextRecorder struct {
+	slog.Handler
+	contexts []context.Context
+}
+
+func (recorder *contextRecorder) Handle(ctx context.Context, record slog.Record) error {
+	recorder.contexts = append(recorder.contexts, ctx)
+	return nil
+}
+
+func TestTools_ErrorJSONForRequest(test *testing.T) {
+	recorder := &contextRecorder{Handler: slog.NewTextHandler(io.Discard, nil)}
+	testTools := Tools{Logger: slog.New(recorder)}
+
+	type ctxKey struct{}
+	for _, entry := range requestIDTests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request = request.WithContext(context.WithValue(request.Context(), ctxKey{}, entry.name))
+		if entry.incoming != "" {
+			request.Header.Set("X-Request-ID", entry.incoming)
+		}
+		responseRecorder := httptest.NewRecorder()
+		_ = testTools.ErrorJSONForRequest(responseRecorder, request, errors.New("some error"))
+
+		var payload JSONResponse
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&payload); err != nil {
+			test.Fatalf("%s: %v", entry.name, err)
+		}
+		headerID := responseRecorder.Header().Get("X-Request-ID")
+		if headerID == "" || headerID != payload.RequestID || (headerID == entry.incoming) != entry.expectSame {
+			test.Errorf("%s: unexpected request id: header %q, payload %q", entry.name, headerID, payload.RequestID)
+		}
+		if logged := recorder.contexts[len(recorder.contexts)-1]; logged.Value(ctxKey{}) != entry.name {
+			test.Errorf("%s: expected the error to be logged with the request context", entry.name)
+		}
+	}
+}
+
+func TestNewRequestID(test *testing.T) {
+	seen := make(map[string]bool)
+	for idx := 0; idx < 100; idx++ {
+		requestID := newRequestID()
+		if len(requestID) != 20 || !validRequestID(requestID) || seen[requestID] {
+			test.Fatalf("unexpected request id %q", requestID)
+		}
+		seen[requestID] = true
+	}
+}
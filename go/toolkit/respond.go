@@ -0,0 +1,333 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EncoderFunc marshals data for a response, indenting the output when pretty is true
+type EncoderFunc func(data interface{}, pretty bool) ([]byte, error)
+
+// XSSIPrefix is the conventional anti-XSSI prefix for JSONPrefix, which makes a response
+// unparseable when it is included from another site with a <script> tag
+const XSSIPrefix = ")]}',\n"
+
+// ErrInvalidJSONPCallback is returned by WriteResponse when the requested JSONP callback is not
+// a plain JavaScript identifier or dotted path
+var ErrInvalidJSONPCallback = errors.New("invalid JSONP callback name")
+
+// jsonpCallbackPattern allows identifiers and dotted paths such as jQuery.handlers.cb_12
+var jsonpCallbackPattern = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+
+// reservedJavaScriptWords can not be used as a callback name
+var reservedJavaScriptWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "else": true, "enum": true,
+	"export": true, "extends": true, "false": true, "finally": true, "for": true, "function": true,
+	"if": true, "implements": true, "import": true, "in": true, "instanceof": true, "interface": true,
+	"let": true, "new": true, "null": true, "package": true, "private": true, "protected": true,
+	"public": true, "return": true, "static": true, "super": true, "switch": true, "this": true,
+	"throw": true, "true": true, "try": true, "typeof": true, "var": true, "void": true,
+	"while": true, "with": true, "yield": true, "eval": true, "arguments": true,
+}
+
+// validJSONPCallback reports whether name is safe to echo into a JavaScript response
+func validJSONPCallback(name string) bool {
+	if len(name) == 0 || len(name) > 128 || !jsonpCallbackPattern.MatchString(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if reservedJavaScriptWords[part] {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalJSON encodes data as JSON, escaping HTML characters unless DisableHTMLEscape is set
+func (tools *Tools) marshalJSON(data interface{}, pretty bool) ([]byte, error) {
+	var output bytes.Buffer
+	jsonEncoder := json.NewEncoder(&output)
+	jsonEncoder.SetEscapeHTML(!tools.DisableHTMLEscape)
+	if pretty {
+		jsonEncoder.SetIndent("", "  ")
+	}
+	if err := jsonEncoder.Encode(data); err != nil {
+		return nil, err
+	}
+	// Encode terminates each value with a newline, which json.Marshal does not
+	return bytes.TrimSuffix(output.Bytes(), []byte("\n")), nil
+}
+
+// EncodeXML is an EncoderFunc producing XML, for Encoders; WriteResponse only sends XML when it is
+// registered, as browsers list application/xml in their Accept headers, and not every value, a map
+// for example, can be marshalled as XML
+//
+//	tools.Encoders = map[string]toolkit.EncoderFunc{"application/xml": toolkit.EncodeXML, "text/xml": toolkit.EncodeXML}
+func EncodeXML(data interface{}, pretty bool) ([]byte, error) {
+	var output []byte
+	var err error
+	if pretty {
+		output, err = xml.MarshalIndent(data, "", "  ")
+	} else {
+		output, err = xml.Marshal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), output...), nil
+}
+
+// default number of bytes a response body must reach before WriteResponse compresses it
+const defaultCompressionThreshold = 1024
+
+// ResponseOptions holds optional, per response settings for WriteResponse
+type ResponseOptions struct {
+	// Headers are copied onto the response
+	Headers http.Header
+	// ETag computes a strong ETag from the body and answers a matching If-None-Match with 304 Not Modified
+	ETag bool
+	// CacheControl, if set, is sent as the Cache-Control header
+	CacheControl string
+	// LastModified, if set, is sent as the Last-Modified header and checked against If-Modified-Since
+	LastModified time.Time
+}
+
+// WriteResponse writes data in the representation the request's Accept header prefers
+// JSON is used by default and for application/* or */*; the media types in Encoders, such as XML with
+// EncodeXML, can be selected by Accept, and JSON is sent instead if their encoder fails
+// output is indented when the query string has ?pretty or the accepted media type has a pretty parameter
+// bodies of at least CompressionThreshold bytes (default 1024) are gzip or deflate compressed when
+// the client accepts it, unless DisableResponseCompression is set
+// when JSONPCallbackParameter is set, a GET with that query parameter is answered as JSONP, provided
+// the callback is a plain identifier; otherwise ErrInvalidJSONPCallback is returned and nothing is written
+// JSONPrefix, DisableHTMLEscape and NoSniff apply as they do for WriteJSON
+// with ETag set in options (or EnableETags on Tools) or a LastModified time, successful GET and HEAD
+// requests whose If-None-Match or If-Modified-Since match the response get 304 Not Modified and no body
+func (tools *Tools) WriteResponse(responseWriter http.ResponseWriter, request *http.Request, status int, data interface{}, options ...ResponseOptions) error {
+	var responseOptions ResponseOptions
+	if len(options) > 0 {
+		responseOptions = options[0]
+	}
+
+	mediaType, encoder, pretty := tools.negotiateEncoder(request.Header.Get("Accept"))
+	if value, ok := request.URL.Query()["pretty"]; ok {
+		pretty = len(value) == 0 || (value[0] != "false" && value[0] != "0")
+	}
+
+	callback := ""
+	if tools.JSONPCallbackParameter != "" && request.Method == http.MethodGet {
+		if values, ok := request.URL.Query()[tools.JSONPCallbackParameter]; ok {
+			callback = values[0]
+			if !validJSONPCallback(callback) {
+				return ErrInvalidJSONPCallback
+			}
+			mediaType, encoder = "application/json", tools.marshalJSON
+		}
+	}
+
+	output, err := encoder(data, pretty)
+	if err != nil && mediaType != "application/json" {
+		// the data may not suit the format the client preferred, but JSON is always acceptable to us
+		mediaType = "application/json"
+		output, err = tools.marshalJSON(data, pretty)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case callback != "":
+		// the leading comment stops the response being sniffed as anything but script
+		output = append(append([]byte("/**/"+callback+"("), output...), ");"...)
+		mediaType = "application/javascript; charset=utf-8"
+	case mediaType == "application/json":
+		output = append([]byte(tools.JSONPrefix), output...)
+	}
+
+	for key, value := range responseOptions.Headers {
+		responseWriter.Header()[key] = value
+	}
+	responseWriter.Header().Set("Content-Type", mediaType)
+	responseWriter.Header().Add("Vary", "Accept")
+	if tools.NoSniff {
+		responseWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	digest := sha256.Sum256(output)
+	output, err = tools.compressResponse(responseWriter, request, output)
+	if err != nil {
+		return err
+	}
+
+	if responseOptions.CacheControl != "" {
+		responseWriter.Header().Set("Cache-Control", responseOptions.CacheControl)
+	}
+	if !responseOptions.LastModified.IsZero() {
+		responseWriter.Header().Set("Last-Modified", responseOptions.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if responseOptions.ETag || tools.EnableETags {
+		// representations with a different content coding must not share a strong ETag
+		tag := base64.RawURLEncoding.EncodeToString(digest[:16])
+		if encoding := responseWriter.Header().Get("Content-Encoding"); encoding != "" {
+			tag += "-" + encoding
+		}
+		responseWriter.Header().Set("ETag", `"`+tag+`"`)
+	}
+
+	if status == http.StatusOK && notModified(request, responseWriter.Header()) {
+		responseWriter.Header().Del("Content-Type")
+		responseWriter.Header().Del("Content-Encoding")
+		responseWriter.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	responseWriter.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	responseWriter.WriteHeader(status)
+	_, err = responseWriter.Write(output)
+	return err
+}
+
+// notModified evaluates the conditional headers of a GET or HEAD request against the response headers
+// If-None-Match takes precedence over If-Modified-Since, as RFC 9110 requires
+func notModified(request *http.Request, header http.Header) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// If-None-Match uses the weak comparison
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// compressResponse compresses output when it is large enough and the client accepts it
+func (tools *Tools) compressResponse(responseWriter http.ResponseWriter, request *http.Request, output []byte) ([]byte, error) {
+	if tools.DisableResponseCompression {
+		return output, nil
+	}
+	responseWriter.Header().Add("Vary", "Accept-Encoding")
+
+	threshold := defaultCompressionThreshold
+	if tools.CompressionThreshold > 0 {
+		threshold = tools.CompressionThreshold
+	}
+	if len(output) < threshold {
+		return output, nil
+	}
+
+	encoding := negotiateEncoding(request.Header.Get("Accept-Encoding"), onTheFlyEncodings)
+	if encoding == "" {
+		return output, nil
+	}
+
+	var compressed bytes.Buffer
+	compressor, err := newCompressionWriter(&compressed, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := compressor.Write(output); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	responseWriter.Header().Set("Content-Encoding", encoding)
+	return compressed.Bytes(), nil
+}
+
+// negotiateEncoder picks the media type and encoder best matching an Accept header
+// and reports whether the chosen media range asked for pretty output
+func (tools *Tools) negotiateEncoder(accept string) (string, EncoderFunc, bool) {
+	lookup := func(mediaType string) (EncoderFunc, bool) {
+		if encoder, ok := tools.Encoders[mediaType]; ok {
+			return encoder, true
+		}
+		if mediaType == "application/json" {
+			return tools.marshalJSON, true
+		}
+		return nil, false
+	}
+	jsonEncoder, _ := lookup("application/json")
+
+	for _, mediaRange := range sortByQuality(accept) {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		pretty := params["pretty"] != "" && params["pretty"] != "false" && params["pretty"] != "0"
+
+		if encoder, ok := lookup(mediaType); ok {
+			return mediaType, encoder, pretty
+		}
+		switch {
+		case mediaType == "*/*", mediaType == "application/*", strings.HasSuffix(mediaType, "+json"):
+			return "application/json", jsonEncoder, pretty
+		}
+	}
+
+	// nothing acceptable was offered, so fall back to JSON rather than failing the request
+	return "application/json", jsonEncoder, false
+}
+
+// sortByQuality orders the elements of an Accept style header by descending q weight
+// elements with equal weight keep the order the client sent them in, and refused elements are dropped
+func sortByQuality(header string) []string {
+	type weighted struct {
+		value   string
+		quality float64
+	}
+
+	var values []weighted
+	for _, part := range strings.Split(header, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		_, quality := parseQualityValue(part)
+		if quality <= 0 {
+			continue
+		}
+		values = append(values, weighted{value: strings.TrimSpace(part), quality: quality})
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].quality > values[j].quality
+	})
+
+	sorted := make([]string, len(values))
+	for idx, entry := range values {
+		sorted[idx] = entry.value
+	}
+	return sorted
+}
@@ -0,0 +1,292 @@
+package toolkit
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type respondPayload struct {
+	XMLName xml.Name `json:"-" xml:"payload"`
+	Message string   `json:"message" xml:"message"`
+}
+
+var writeResponseTests = []struct {
+	name             string
+	url              string
+	accept           string
+	acceptEncoding   string
+	message          string
+	expectedType     string
+	expectedEncoding string
+	expectedPrefix   string
+	expectedIndent   bool
+}{
+	{name: "default json", url: "/", message: "hello", expectedType: "application/json", expectedPrefix: `{"message":"hello"}`},
+	{name: "wildcard", url: "/", accept: "*/*", message: "hello", expectedType: "application/json", expectedPrefix: `{"message":"hello"}`},
+	{name: "xml", url: "/", accept: "application/xml", message: "hello", expectedType: "application/xml", expectedPrefix: `<?xml`},
+	{name: "weighted xml", url: "/", accept: "application/json;q=0.4, text/xml", message: "hello", expectedType: "text/xml", expectedPrefix: `<?xml`},
+	{name: "custom encoder", url: "/", accept: "text/plain", message: "hello", expectedType: "text/plain", expectedPrefix: `hello`},
+	{name: "unknown type falls back to json", url: "/", accept: "image/png", message: "hello", expectedType: "application/json", expectedPrefix: `{"message":"hello"}`},
+	{name: "pretty query", url: "/?pretty", message: "hello", expectedType: "application/json", expectedIndent: true},
+	{name: "pretty parameter", url: "/", accept: "application/json; pretty=true", message: "hello", expectedType: "application/json", expectedIndent: true},
+	{name: "small body not compressed", url: "/", acceptEncoding: "gzip", message: "hello", expectedType: "application/json", expectedPrefix: `{"message":"hello"}`},
+	{name: "gzip", url: "/", acceptEncoding: "gzip, deflate", message: strings.Repeat("hello", 500), expectedType: "application/json", expectedEncoding: "gzip", expectedPrefix: `{"message":"hello`},
+	{name: "deflate", url: "/", acceptEncoding: "deflate", message: strings.Repeat("hello", 500), expectedType: "application/json", expectedEncoding: "deflate", expectedPrefix: `{"message":"hello`},
+}
+
+func TestTools_WriteResponse(test *testing.T) {
+	testTools := Tools{
+		Encoders: map[string]EncoderFunc{
+			"text/plain": func(data interface{}, pretty bool) ([]byte, error) {
+				return []byte(data.(respondPayload).Message), nil
+			},
+			"application/xml": EncodeXML,
+			"text/xml":        EncodeXML,
+		},
+	}
+
+	for _, entry := range writeResponseTests {
+		request := httptest.NewRequest("GET", entry.url, nil)
+		if entry.accept != "" {
+			request.Header.Set("Accept", entry.accept)
+		}
+		if entry.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", entry.acceptEncoding)
+		}
+		responseRecorder := httptest.NewRecorder()
+
+		headers := make(http.Header)
+		headers.Set("X-Foo", "bar")
+		err := testTools.WriteResponse(responseRecorder, request, http.StatusOK, respondPayload{Message: entry.message}, ResponseOptions{Headers: headers})
+		if err != nil {
+			test.Errorf("%s: %v", entry.name, err)
+			continue
+		}
+
+		response := responseRecorder.Result()
+		if response.Header.Get("Content-Type") != entry.expectedType {
+			test.Errorf("%s: expected content type %s but got %s", entry.name, entry.expectedType, response.Header.Get("Content-Type"))
+		}
+		if response.Header.Get("Content-Encoding") != entry.expectedEncoding {
+			test.Errorf("%s: expected content encoding %q but got %q", entry.name, entry.expectedEncoding, response.Header.Get("Content-Encoding"))
+		}
+		if response.Header.Get("X-Foo") != "bar" {
+			test.Errorf("%s: supplied header missing", entry.name)
+		}
+
+		var body io.Reader = response.Body
+		switch entry.expectedEncoding {
+		case "gzip":
+			body, _ = gzip.NewReader(response.Body)
+		case "deflate":
+			body, _ = zlib.NewReader(response.Body)
+		}
+		decoded, _ := io.ReadAll(body)
+
+		if entry.expectedIndent != strings.Contains(string(decoded), "\n  ") {
+			test.Errorf("%s: unexpected indentation in %s", entry.name, decoded)
+		}
+		if !strings.HasPrefix(string(decoded), entry.expectedPrefix) {
+			test.Errorf("%s: expected body to start with %s but got %.40s", entry.name, entry.expectedPrefix, decoded)
+		}
+	}
+}
+
+// browserAccept is the Accept header browsers send when navigating to a page
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestTools_WriteResponseBrowserAccept(test *testing.T) {
+	tests := []struct {
+		name     string
+		tools    Tools
+		data     interface{}
+		expected string
+	}{
+		{name: "xml not registered", data: respondPayload{Message: "hello"}, expected: "application/json"},
+		{name: "xml registered", tools: Tools{Encoders: map[string]EncoderFunc{"application/xml": EncodeXML}}, data: respondPayload{Message: "hello"}, expected: "application/xml"},
+		{name: "xml fails", tools: Tools{Encoders: map[string]EncoderFunc{"application/xml": EncodeXML}}, data: map[string]interface{}{"message": "hello"}, expected: "application/json"},
+	}
+
+	for _, entry := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Accept", browserAccept)
+		responseRecorder := httptest.NewRecorder()
+
+		if err := entry.tools.WriteResponse(responseRecorder, request, http.StatusOK, entry.data); err != nil {
+			test.Errorf("%s: %v", entry.name, err)
+			continue
+		}
+		if responseRecorder.Header().Get("Content-Type") != entry.expected {
+			test.Errorf("%s: expected %s but got %s", entry.name, entry.expected, responseRecorder.Header().Get("Content-Type"))
+		}
+		if entry.expected == "application/json" && !strings.Contains(responseRecorder.Body.String(), `"message":"hello"`) {
+			test.Errorf("%s: expected a JSON body but got %q", entry.name, responseRecorder.Body.String())
+		}
+	}
+}
+
+func TestTools_WriteResponseCompressionDisabled(test *testing.T) {
+	testTools := Tools{DisableResponseCompression: true}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	responseRecorder := httptest.NewRecorder()
+
+	err := testTools.WriteResponse(responseRecorder, request, http.StatusOK, respondPayload{Message: strings.Repeat("hello", 500)})
+	if err != nil {
+		test.Error(err)
+	}
+	if responseRecorder.Header().Get("Content-Encoding") != "" {
+		test.Error("response was compressed when compression is disabled")
+	}
+}
+
+func TestTools_WriteResponseETag(test *testing.T) {
+	var testTools Tools
+	lastModified := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+	options := ResponseOptions{ETag: true, CacheControl: "private, max-age=5", LastModified: lastModified}
+	payload := respondPayload{Message: "hello"}
+
+	// first request gets the body and validators
+	request := httptest.NewRequest("GET", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	err := testTools.WriteResponse(responseRecorder, request, http.StatusOK, payload, options)
+	if err != nil {
+		test.Fatal(err)
+	}
+	etag := responseRecorder.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || responseRecorder.Body.Len() == 0 {
+		test.Fatalf("expected a strong ETag and a body, got %q", etag)
+	}
+	if responseRecorder.Header().Get("Cache-Control") != "private, max-age=5" {
+		test.Errorf("wrong Cache-Control %q", responseRecorder.Header().Get("Cache-Control"))
+	}
+	if responseRecorder.Header().Get("Last-Modified") != "Wed, 01 Mar 2023 12:00:00 GMT" {
+		test.Errorf("wrong Last-Modified %q", responseRecorder.Header().Get("Last-Modified"))
+	}
+
+	var conditionalTests = []struct {
+		name           string
+		method         string
+		header         string
+		value          string
+		payload        respondPayload
+		expectedStatus int
+	}{
+		{name: "matching etag", method: "GET", header: "If-None-Match", value: etag, payload: payload, expectedStatus: http.StatusNotModified},
+		{name: "weak matching etag in list", method: "GET", header: "If-None-Match", value: `"abc", W/` + etag, payload: payload, expectedStatus: http.StatusNotModified},
+		{name: "changed body", method: "GET", header: "If-None-Match", value: etag, payload: respondPayload{Message: "changed"}, expectedStatus: http.StatusOK},
+		{name: "head request", method: "HEAD", header: "If-None-Match", value: etag, payload: payload, expectedStatus: http.StatusNotModified},
+		{name: "post request", method: "POST", header: "If-None-Match", value: etag, payload: payload, expectedStatus: http.StatusOK},
+		{name: "not modified since", method: "GET", header: "If-Modified-Since", value: "Wed, 01 Mar 2023 12:00:00 GMT", payload: payload, expectedStatus: http.StatusNotModified},
+		{name: "modified since", method: "GET", header: "If-Modified-Since", value: "Tue, 28 Feb 2023 12:00:00 GMT", payload: payload, expectedStatus: http.StatusOK},
+	}
+
+	for _, entry := range conditionalTests {
+		request := httptest.NewRequest(entry.method, "/", nil)
+		request.Header.Set(entry.header, entry.value)
+		responseRecorder := httptest.NewRecorder()
+
+		err := testTools.WriteResponse(responseRecorder, request, http.StatusOK, entry.payload, options)
+		if err != nil {
+			test.Errorf("%s: %v", entry.name, err)
+			continue
+		}
+		if responseRecorder.Code != entry.expectedStatus {
+			test.Errorf("%s: expected status %d but got %d", entry.name, entry.expectedStatus, responseRecorder.Code)
+		}
+		if entry.expectedStatus == http.StatusNotModified && responseRecorder.Body.Len() != 0 {
+			test.Errorf("%s: 304 response must not have a body", entry.name)
+		}
+		if responseRecorder.Header().Get("ETag") == "" {
+			test.Errorf("%s: ETag missing", entry.name)
+		}
+	}
+}
+
+func TestTools_WriteResponseETagPerEncoding(test *testing.T) {
+	testTools := Tools{EnableETags: true}
+	payload := respondPayload{Message: strings.Repeat("hello", 500)}
+
+	plainRequest := httptest.NewRequest("GET", "/", nil)
+	plainRecorder := httptest.NewRecorder()
+	_ = testTools.WriteResponse(plainRecorder, plainRequest, http.StatusOK, payload)
+
+	gzipRequest := httptest.NewRequest("GET", "/", nil)
+	gzipRequest.Header.Set("Accept-Encoding", "gzip")
+	gzipRecorder := httptest.NewRecorder()
+	_ = testTools.WriteResponse(gzipRecorder, gzipRequest, http.StatusOK, payload)
+
+	if plainRecorder.Header().Get("ETag") == "" || plainRecorder.Header().Get("ETag") == gzipRecorder.Header().Get("ETag") {
+		test.Errorf("expected distinct ETags per content coding, got %s and %s", plainRecorder.Header().Get("ETag"), gzipRecorder.Header().Get("ETag"))
+	}
+}
+
+var jsonHardeningTests = []struct {
+	name              string
+	url               string
+	tools             Tools
+	expectedStatus    int
+	expectedType      string
+	expectedBody      string
+	expectedNoSniff   bool
+	callbackErrorWant bool
+}{
+	{name: "default escapes html", url: "/", tools: Tools{}, expectedType: "application/json", expectedBody: `{"message":"\u003cb\u003e"}`},
+	{name: "html escaping disabled", url: "/", tools: Tools{DisableHTMLEscape: true}, expectedType: "application/json", expectedBody: `{"message":"<b>"}`},
+	{name: "xssi prefix", url: "/", tools: Tools{JSONPrefix: XSSIPrefix}, expectedType: "application/json", expectedBody: ")]}',\n" + `{"message":"\u003cb\u003e"}`},
+	{name: "nosniff", url: "/", tools: Tools{NoSniff: true}, expectedType: "application/json", expectedBody: `{"message":"\u003cb\u003e"}`, expectedNoSniff: true},
+	{name: "jsonp", url: "/?callback=app.handlers.done", tools: Tools{JSONPCallbackParameter: "callback", JSONPrefix: XSSIPrefix}, expectedType: "application/javascript; charset=utf-8", expectedBody: `/**/app.handlers.done({"message":"\u003cb\u003e"});`},
+	{name: "jsonp not requested", url: "/", tools: Tools{JSONPCallbackParameter: "callback"}, expectedType: "application/json", expectedBody: `{"message":"\u003cb\u003e"}`},
+	{name: "jsonp script injection", url: "/?callback=alert(1)//", tools: Tools{JSONPCallbackParameter: "callback"}, callbackErrorWant: true},
+	{name: "jsonp reserved word", url: "/?callback=window.eval", tools: Tools{JSONPCallbackParameter: "callback"}, callbackErrorWant: true},
+	{name: "jsonp empty", url: "/?callback=", tools: Tools{JSONPCallbackParameter: "callback"}, callbackErrorWant: true},
+}
+
+func TestTools_WriteResponseHardening(test *testing.T) {
+	for _, entry := range jsonHardeningTests {
+		request := httptest.NewRequest("GET", entry.url, nil)
+		responseRecorder := httptest.NewRecorder()
+
+		err := entry.tools.WriteResponse(responseRecorder, request, http.StatusOK, respondPayload{Message: "<b>"})
+		if entry.callbackErrorWant {
+			if !errors.Is(err, ErrInvalidJSONPCallback) {
+				test.Errorf("%s: expected ErrInvalidJSONPCallback but got %v", entry.name, err)
+			}
+			if responseRecorder.Body.Len() != 0 {
+				test.Errorf("%s: nothing should be written for a bad callback", entry.name)
+			}
+			continue
+		}
+		if err != nil {
+			test.Errorf("%s: %v", entry.name, err)
+			continue
+		}
+
+		if responseRecorder.Header().Get("Content-Type") != entry.expectedType {
+			test.Errorf("%s: expected content type %s but got %s", entry.name, entry.expectedType, responseRecorder.Header().Get("Content-Type"))
+		}
+		if responseRecorder.Body.String() != entry.expectedBody {
+			test.Errorf("%s: expected body %s but got %s", entry.name, entry.expectedBody, responseRecorder.Body.String())
+		}
+		if (responseRecorder.Header().Get("X-Content-Type-Options") == "nosniff") != entry.expectedNoSniff {
+			test.Errorf("%s: unexpected X-Content-Type-Options %q", entry.name, responseRecorder.Header().Get("X-Content-Type-Options"))
+		}
+
+		// WriteJSON shares the same output options, apart from JSONP
+		if entry.tools.JSONPCallbackParameter == "" {
+			jsonRecorder := httptest.NewRecorder()
+			_ = entry.tools.WriteJSON(jsonRecorder, http.StatusOK, respondPayload{Message: "<b>"})
+			if jsonRecorder.Body.String() != entry.expectedBody {
+				test.Errorf("%s: WriteJSON wrote %s", entry.name, jsonRecorder.Body.String())
+			}
+		}
+	}
+}
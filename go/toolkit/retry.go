@@ -0,0 +1,202 @@
+package toolkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultIdempotencyKeyHeader is the header retried POST and PATCH requests carry when
+// IdempotencyKeyHeader is empty
+const DefaultIdempotencyKeyHeader = "Idempotency-Key"
+
+// retry policy defaults, used for fields left at zero
+const (
+	defaultRetryAttempts  = 3
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+	defaultMaxRetryAfter  = time.Minute
+)
+
+// RetryPolicy configures how calls to remote services are retried
+// a request is retried after a connection error, a 429 Too Many Requests, or a 5xx status other
+// than 501 Not Implemented and 505 HTTP Version Not Supported, until MaxAttempts have been made
+// between attempts it waits an exponentially growing backoff with jitter, or as long as the
+// response's Retry-After header asks, whichever is longer
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first; 3 when zero
+	MaxAttempts int
+	// InitialBackoff is the wait before the second attempt, which doubles each attempt; 100ms when zero
+	InitialBackoff time.Duration
+	// MaxBackoff caps the computed backoff; 10 seconds when zero
+	MaxBackoff time.Duration
+	// MaxRetryAfter is the longest Retry-After that is honored, a longer one ends the retries; 1 minute when zero
+	MaxRetryAfter time.Duration
+	// IdempotencyKeyHeader carries a key, generated once per call, on POST and PATCH requests so
+	// the server can recognise a retried request; Idempotency-Key when empty
+	// the key is not replaced if the request already has the header
+	IdempotencyKeyHeader string
+	// DisableIdempotencyKey stops the idempotency key header being sent
+	DisableIdempotencyKey bool
+}
+
+// maxAttempts is the configured number of attempts or the default
+func (policy *RetryPolicy) maxAttempts() int {
+	if policy.MaxAttempts > 0 {
+		return policy.MaxAttempts
+	}
+	return defaultRetryAttempts
+}
+
+// backoff is the jittered wait before retry number attempt (1 for the first retry)
+// half of the exponential backoff is fixed and the other half random, so concurrent clients spread out
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, maxBackoff := policy.InitialBackoff, policy.MaxBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	wait := initial
+	for idx := 1; idx < attempt && wait < maxBackoff; idx++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait/2 + time.Duration(mathrand.Int63n(int64(wait/2)+1))
+}
+
+// retryableStatus reports whether a response status is worth retrying
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// newIdempotencyKey returns a random key for the idempotency key header
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	return hex.EncodeToString(key)
+}
+
+// sendWithRetry sends request with httpClient, through breaker if there is one, retrying as policy describes
+// a nil policy makes a single attempt; the body is replayed on each attempt with request.GetBody
+// signer, if set, signs each attempt afresh, so a receiver's replay check does not reject retries
+// when every attempt fails, the last response or error is returned; an open circuit ends the retries
+func sendWithRetry(httpClient *http.Client, request *http.Request, policy *RetryPolicy, breaker *CircuitBreaker, signer *WebhookSigner) (*http.Response, error) {
+	if policy == nil {
+		if signer != nil {
+			if err := signer.SignRequest(request); err != nil {
+				return nil, err
+			}
+		}
+		return sendOnce(httpClient, request, breaker)
+	}
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return nil, errors.New("request body can not be replayed for retries")
+	}
+
+	if !policy.DisableIdempotencyKey && (request.Method == http.MethodPost || request.Method == http.MethodPatch) {
+		header := policy.IdempotencyKeyHeader
+		if header == "" {
+			header = DefaultIdempotencyKeyHeader
+		}
+		if request.Header.Get(header) == "" {
+			request.Header.Set(header, newIdempotencyKey())
+		}
+	}
+
+	maxRetryAfter := policy.MaxRetryAfter
+	if maxRetryAfter <= 0 {
+		maxRetryAfter = defaultMaxRetryAfter
+	}
+
+	ctx := request.Context()
+	for attempt := 1; ; attempt++ {
+		attemptRequest := request
+		if attempt > 1 && request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptRequest = request.Clone(ctx)
+			attemptRequest.Body = body
+		}
+		if signer != nil {
+			if err := signer.SignRequest(attemptRequest); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := sendOnce(httpClient, attemptRequest, breaker)
+		if attempt >= policy.maxAttempts() || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+			return response, err
+		}
+		if err == nil && !retryableStatus(response.StatusCode) {
+			return response, nil
+		}
+
+		wait := policy.backoff(attempt)
+		if err == nil {
+			if requested, ok := retryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+				if requested > maxRetryAfter {
+					// the server will not be ready in time, so give up with its answer
+					return response, nil
+				}
+				if requested > wait {
+					wait = requested
+				}
+			}
+			// drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, megabyte))
+			_ = response.Body.Close()
+		}
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleepContext waits for duration, returning early with the context's error if it is done first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
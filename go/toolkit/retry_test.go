@@ -0,0 +1,136 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with status, then echoes the request body
+// every request must carry the same body and idempotency key
+func flakyServer(test *testing.T, failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	var attempts int32
+	var firstKey atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		attempt := atomic.AddInt32(&attempts, 1)
+		body, _ := io.ReadAll(request.Body)
+		if string(body) != `{"name":"retry"}` {
+			test.Errorf("attempt %d: body was not replayed: %q", attempt, body)
+		}
+		key := request.Header.Get(DefaultIdempotencyKeyHeader)
+		if attempt == 1 {
+			firstKey.Store(key)
+		}
+		if key == "" || key != firstKey.Load() {
+			test.Errorf("attempt %d: expected a stable idempotency key but got %q", attempt, key)
+		}
+
+		if attempt <= failures {
+			if retryAfter != "" {
+				responseWriter.Header().Set("Retry-After", retryAfter)
+			}
+			responseWriter.WriteHeader(status)
+			return
+		}
+		responseWriter.Header().Set("Content-Type", "application/json")
+		_, _ = responseWriter.Write(body)
+	}))
+	return server, &attempts
+}
+
+var retryTests = []struct {
+	name             string
+	failures         int32
+	status           int
+	retryAfter       string
+	expectedAttempts int32
+	expectedStatus   int
+}{
+	{name: "recovers from 503", failures: 2, status: http.StatusServiceUnavailable, expectedAttempts: 3, expectedStatus: http.StatusOK},
+	{name: "recovers from 429 with retry-after", failures: 1, status: http.StatusTooManyRequests, retryAfter: "0", expectedAttempts: 2, expectedStatus: http.StatusOK},
+	{name: "gives up after max attempts", failures: 5, status: http.StatusBadGateway, expectedAttempts: 3, expectedStatus: http.StatusBadGateway},
+	{name: "client errors are not retried", failures: 1, status: http.StatusBadRequest, expectedAttempts: 1, expectedStatus: http.StatusBadRequest},
+	{name: "retry-after too long", failures: 1, status: http.StatusServiceUnavailable, retryAfter: "3600", expectedAttempts: 1, expectedStatus: http.StatusServiceUnavailable},
+}
+
+func TestJSONClientRetry(test *testing.T) {
+	for _, entry := range retryTests {
+		server, attempts := flakyServer(test, entry.failures, entry.status, entry.retryAfter)
+		client, _ := NewJSONClient(server.URL)
+		client.Retry = &RetryPolicy{InitialBackoff: time.Millisecond}
+
+		var echoed map[string]string
+		response, err := client.Post(context.Background(), "items", map[string]string{"name": "retry"}, &echoed)
+		server.Close()
+
+		if *attempts != entry.expectedAttempts {
+			test.Errorf("%s: expected %d attempts but made %d", entry.name, entry.expectedAttempts, *attempts)
+		}
+		if response == nil || response.StatusCode != entry.expectedStatus {
+			test.Errorf("%s: expected status %d but got %v, %v", entry.name, entry.expectedStatus, response, err)
+			continue
+		}
+		if entry.expectedStatus == http.StatusOK && (err != nil || echoed["name"] != "retry") {
+			test.Errorf("%s: unexpected result %v, %v", entry.name, echoed, err)
+		}
+	}
+}
+
+func TestTools_PostJSONToRemoteRetry(test *testing.T) {
+	server, attempts := flakyServer(test, 1, http.StatusInternalServerError, "")
+	defer server.Close()
+
+	testTools := Tools{RemoteRetry: &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}}
+	remoteURI, _ := url.Parse(server.URL)
+	response, status, err := testTools.PostJSONToRemote(*remoteURI, map[string]string{"name": "retry"})
+	if err != nil || status != http.StatusOK || *attempts != 2 {
+		test.Errorf("expected success on the second attempt but got %d after %d attempts: %v", status, *attempts, err)
+	}
+	if body, _ := io.ReadAll(response.Body); string(body) != `{"name":"retry"}` {
+		test.Errorf("expected the response body to be readable but got %q", body)
+	}
+}
+
+func TestRetryContextCancelled(test *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client, _ := NewJSONClient(server.URL)
+	client.Retry = &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second}
+
+	started := time.Now()
+	_, err := client.Get(ctx, "/", nil)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(started) > time.Second {
+		test.Errorf("expected the deadline to end the retries but got %v after %v", err, time.Since(started))
+	}
+}
+
+func TestRetryPolicyBackoff(test *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		for idx := 0; idx < 20; idx++ {
+			wait := policy.backoff(attempt)
+			if wait < expected/2 || wait > expected {
+				test.Errorf("attempt %d: backoff %v is outside [%v, %v]", attempt, wait, expected/2, expected)
+			}
+		}
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if wait, ok := retryAfter("Mon, 01 Jan 2024 00:00:30 GMT", now); !ok || wait != 30*time.Second {
+		test.Errorf("expected 30s from an HTTP date but got %v", wait)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		test.Error("expected an invalid Retry-After to be ignored")
+	}
+}
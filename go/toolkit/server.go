@@ -0,0 +1,223 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// graceful server defaults, used for fields left at zero
+const (
+	defaultDrainTimeout = 30 * time.Second
+	defaultHookTimeout  = 10 * time.Second
+)
+
+// ErrForcedShutdown is returned by GracefulServer when it closed connections which had not finished,
+// because DrainTimeout passed or a second signal arrived
+var ErrForcedShutdown = errors.New("server closed before connections finished")
+
+// ShutdownHook is a cleanup step, such as closing a database, run after a server stops
+// it should give up when ctx is done
+type ShutdownHook func(ctx context.Context) error
+
+// GracefulServer runs an http.Server until SIGINT or SIGTERM arrives, as CloseListener listens for,
+// then stops accepting connections, gives requests in flight DrainTimeout to finish and runs the
+// shutdown hooks in the order they were registered, followed by those of Hooks
+// a second signal, or DrainTimeout passing, closes the remaining connections at once; rather than
+// exiting, Serve and ListenAndServe return, with an error if anything failed, so main can decide
+type GracefulServer struct {
+	// Server is the server to run
+	Server *http.Server
+	// DrainTimeout is how long requests in flight have to finish; 30 seconds when zero
+	DrainTimeout time.Duration
+	// HookTimeout is how long the shutdown hooks have together to finish; 10 seconds when zero
+	// it does not cover Hooks, whose hooks each have their own timeout
+	HookTimeout time.Duration
+	// Signals start the shutdown; SIGINT and SIGTERM when empty
+	Signals []os.Signal
+	// Hooks, if set, is shut down after the server and its own hooks, with each hook's own timeout,
+	// cut short only by a second signal; do not also call its Listen
+	Hooks *ShutdownManager
+
+	tools    *Tools
+	mutex    sync.Mutex
+	hooks    []ShutdownHook
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewGracefulServer wraps server, logging the shutdown with Tools' Logger if one is set
+func (tools *Tools) NewGracefulServer(server *http.Server) *GracefulServer {
+	return &GracefulServer{Server: server, tools: tools}
+}
+
+// OnShutdown registers hook to run after the server stops, after the hooks registered before it
+func (server *GracefulServer) OnShutdown(hook ShutdownHook) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.hooks = append(server.hooks, hook)
+}
+
+// Stop starts the shutdown as a signal would; Serve returns when it is complete
+func (server *GracefulServer) Stop() {
+	server.stopOnce.Do(func() {
+		close(server.stopped())
+	})
+}
+
+// stopped is closed by Stop; it is made on first use, so a GracefulServer literal works too
+func (server *GracefulServer) stopped() chan struct{} {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.stop == nil {
+		server.stop = make(chan struct{})
+	}
+	return server.stop
+}
+
+// ListenAndServe listens on the TCP address of Server, ":http" when empty, then calls Serve
+func (server *GracefulServer) ListenAndServe() error {
+	address := server.Server.Addr
+	if address == "" {
+		address = ":http"
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// Serve accepts connections on listener until a signal arrives or Stop is called, then shuts down
+// the error joins any failure to serve, ErrForcedShutdown and the errors of the shutdown hooks
+func (server *GracefulServer) Serve(listener net.Listener) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, shutdownSignals(server.Signals)...)
+	defer signal.Stop(signals)
+
+	stopped := server.stopped()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Server.Serve(listener)
+	}()
+
+	var serveErr error
+	select {
+	case serveErr = <-served:
+		// the server failed, or was shut down elsewhere, but still clean up after it
+		if errors.Is(serveErr, http.ErrServerClosed) {
+			serveErr = nil
+		}
+		served = nil
+	case received := <-signals:
+		server.log("shutting down", slog.String("signal", received.String()))
+	case <-stopped:
+		server.log("shutting down")
+	}
+
+	// a second signal cuts the shutdown short
+	forced, force := context.WithCancel(context.Background())
+	defer force()
+	go func() {
+		select {
+		case received := <-signals:
+			server.log("forcing shutdown", slog.String("signal", received.String()))
+			force()
+		case <-forced.Done():
+		}
+	}()
+
+	var shutdownErr error
+	if served != nil {
+		shutdownErr = server.drain(forced)
+		<-served
+	}
+	hookErr := server.runHooks(forced)
+	return errors.Join(serveErr, shutdownErr, hookErr)
+}
+
+// drain stops the server, closing it when its connections do not finish in time
+func (server *GracefulServer) drain(forced context.Context) error {
+	ctx, cancel := context.WithTimeout(forced, durationOrDefault(server.DrainTimeout, defaultDrainTimeout))
+	defer cancel()
+
+	err := server.Server.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	closeErr := server.Server.Close()
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		err = ErrForcedShutdown
+	}
+	return errors.Join(err, closeErr)
+}
+
+// runHooks runs the shutdown hooks in order, until HookTimeout passes or the shutdown is forced
+// a hook which does not return by then is abandoned, and those after it are not run
+// Hooks is then shut down within forced alone, so HookTimeout does not cap its hooks' timeouts
+func (server *GracefulServer) runHooks(forced context.Context) error {
+	server.mutex.Lock()
+	hooks := append([]ShutdownHook(nil), server.hooks...)
+	server.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(forced, durationOrDefault(server.HookTimeout, defaultHookTimeout))
+	defer cancel()
+
+	var errs []error
+	for _, hook := range hooks {
+		if err := callShutdownHook(ctx, hook); err != nil {
+			server.log("shutdown hook failed", slog.String("error", err.Error()))
+			errs = append(errs, err)
+		}
+	}
+	if server.Hooks != nil {
+		errs = append(errs, server.Hooks.Shutdown(forced))
+	}
+	return errors.Join(errs...)
+}
+
+// callShutdownHook runs hook until it returns, panics or ctx is done
+// a hook which ignores ctx is left running, as it can not be stopped, but is no longer waited for
+func callShutdownHook(ctx context.Context, hook ShutdownHook) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				result <- fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		result <- hook(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (server *GracefulServer) log(message string, attributes ...slog.Attr) {
+	if server.tools == nil || server.tools.Logger == nil {
+		return
+	}
+	server.tools.Logger.LogAttrs(context.Background(), slog.LevelInfo, message, attributes...)
+}
+
+func durationOrDefault(duration, fallback time.Duration) time.Duration {
+	if duration > 0 {
+		return duration
+	}
+	return fallback
+}
@@ -0,0 +1,245 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startGracefulServer serves handler on a free port, returning its URL and the result of Serve
+func startGracefulServer(test *testing.T, server *GracefulServer, handler http.Handler) (string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	server.Server.Handler = handler
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Serve(listener)
+	}()
+	return "http://" + listener.Addr().String(), result
+}
+
+func waitForResult(test *testing.T, result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		test.Fatal("server did not shut down")
+		return nil
+	}
+}
+
+func TestGracefulServer_Drain(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+
+	var mutex sync.Mutex
+	var events []string
+	record := func(event string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	}
+	server.OnShutdown(func(ctx context.Context) error {
+		record("close database")
+		return nil
+	})
+	server.OnShutdown(func(ctx context.Context) error {
+		record("flush logs")
+		return nil
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	url, result := startGracefulServer(test, server, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+		record("request finished")
+		responseWriter.WriteHeader(http.StatusOK)
+	}))
+
+	status := make(chan int, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = response.Body.Close()
+		status <- response.StatusCode
+	}()
+
+	<-started
+	server.Stop()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if code := <-status; code != http.StatusOK {
+		test.Errorf("expected request in flight to finish, got status %d", code)
+	}
+	if err := waitForResult(test, result); err != nil {
+		test.Errorf("expected clean shutdown, got %v", err)
+	}
+	if strings.Join(events, ", ") != "request finished, close database, flush logs" {
+		test.Errorf("wrong order: %v", events)
+	}
+}
+
+func TestGracefulServer_DrainTimeout(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+	server.DrainTimeout = 50 * time.Millisecond
+
+	hookErr := errors.New("queue not drained")
+	hookRan := false
+	server.OnShutdown(func(ctx context.Context) error {
+		hookRan = true
+		return hookErr
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	url, result := startGracefulServer(test, server, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+	}))
+	go func() {
+		if response, err := http.Get(url); err == nil {
+			_ = response.Body.Close()
+		}
+	}()
+
+	<-started
+	server.Stop()
+	err := waitForResult(test, result)
+	if !errors.Is(err, ErrForcedShutdown) {
+		test.Errorf("expected forced shutdown, got %v", err)
+	}
+	if !hookRan || !errors.Is(err, hookErr) {
+		test.Errorf("expected hook to run and its error to be returned, got %v", err)
+	}
+}
+
+func TestGracefulServer_SecondSignal(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+	// not SIGINT, which the CloseListener test has told to exit the process
+	server.Signals = []os.Signal{syscall.SIGHUP}
+
+	hookRan := false
+	server.OnShutdown(func(ctx context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	url, result := startGracefulServer(test, server, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+	}))
+	go func() {
+		if response, err := http.Get(url); err == nil {
+			_ = response.Body.Close()
+		}
+	}()
+	<-started
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		test.Skip("can not signal this process: ", err)
+	}
+
+	// wait until the first signal has closed the listener before sending the second
+	address := strings.TrimPrefix(url, "http://")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		connection, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		_ = connection.Close()
+	}
+	_ = process.Signal(syscall.SIGHUP)
+
+	err = waitForResult(test, result)
+	if !errors.Is(err, ErrForcedShutdown) {
+		test.Errorf("expected forced shutdown, got %v", err)
+	}
+	if hookRan || !errors.Is(err, context.Canceled) {
+		test.Errorf("expected hooks to be skipped once the shutdown is forced, got %v", err)
+	}
+}
+
+func TestGracefulServer_ServeError(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+	hookRan := false
+	server.OnShutdown(func(ctx context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	_ = listener.Close()
+
+	if err := server.Serve(listener); err == nil {
+		test.Error("expected error serving a closed listener")
+	}
+	if !hookRan {
+		test.Error("expected hooks to run after the server failed")
+	}
+}
+
+func TestGracefulServer_Literal(test *testing.T) {
+	server := &GracefulServer{Server: &http.Server{}}
+	_, result := startGracefulServer(test, server, http.NotFoundHandler())
+	server.Stop()
+	server.Stop()
+	if err := waitForResult(test, result); err != nil {
+		test.Errorf("expected clean shutdown, got %v", err)
+	}
+}
+
+func TestGracefulServer_StuckHook(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+	server.HookTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	server.OnShutdown(func(ctx context.Context) error {
+		// ignores ctx
+		<-release
+		return nil
+	})
+	laterRan := false
+	server.OnShutdown(func(ctx context.Context) error {
+		laterRan = true
+		return nil
+	})
+
+	_, result := startGracefulServer(test, server, http.NotFoundHandler())
+	server.Stop()
+	if err := waitForResult(test, result); !errors.Is(err, context.DeadlineExceeded) {
+		test.Errorf("expected the stuck hook to time out, got %v", err)
+	}
+	if laterRan {
+		test.Error("expected hooks after the timeout not to run")
+	}
+}
@@ -0,0 +1,182 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownError is the failure of one shutdown hook
+type ShutdownError struct {
+	// Name is the name the hook was registered with
+	Name string
+	Err  error
+}
+
+func (shutdownError *ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown hook %q: %v", shutdownError.Name, shutdownError.Err)
+}
+
+func (shutdownError *ShutdownError) Unwrap() error {
+	return shutdownError.Err
+}
+
+// registeredHook is a ShutdownHook with its place in the shutdown
+type registeredHook struct {
+	name     string
+	priority int
+	timeout  time.Duration
+	order    int
+	run      ShutdownHook
+}
+
+// ShutdownManager runs the shutdown hooks of a program's components, such as closing a database,
+// flushing logs or draining a queue, once, when a signal arrives or Shutdown is called
+// hooks run one at a time, highest priority first, and in reverse registration order within a
+// priority, as deferred calls do, so a component registered after those it uses is stopped before them
+// each hook has its own timeout; a hook which fails, panics or times out does not stop the others,
+// and every failure is logged with Tools' Logger, if one is set, and returned as a ShutdownError
+type ShutdownManager struct {
+	// Timeout is how long each hook registered without a timeout has to finish; 10 seconds when zero
+	Timeout time.Duration
+	// Signals start the shutdown after Listen is called; SIGINT and SIGTERM when empty
+	Signals []os.Signal
+
+	tools   *Tools
+	mutex   sync.Mutex
+	hooks   []registeredHook
+	started bool
+	once    sync.Once
+	done    chan struct{}
+	err     error
+}
+
+// NewShutdownManager creates a ShutdownManager, logging the hooks with Tools' Logger if one is set
+func (tools *Tools) NewShutdownManager() *ShutdownManager {
+	return &ShutdownManager{tools: tools}
+}
+
+// Register adds a hook called name, run by priority and then in reverse registration order
+// a timeout of zero uses the manager's Timeout; hooks registered once the shutdown has started are not run
+func (manager *ShutdownManager) Register(name string, priority int, timeout time.Duration, hook ShutdownHook) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.started {
+		return
+	}
+	manager.hooks = append(manager.hooks, registeredHook{
+		name:     name,
+		priority: priority,
+		timeout:  timeout,
+		order:    len(manager.hooks),
+		run:      hook,
+	})
+}
+
+// Listen starts a goroutine which calls Shutdown when one of Signals arrives, as CloseListener does
+// it stops listening once the shutdown starts, so a second signal ends the program as usual
+func (manager *ShutdownManager) Listen() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals(manager.Signals)...)
+	done := manager.doneChannel()
+	go func() {
+		select {
+		case received := <-signals:
+			manager.log(slog.LevelInfo, "shutting down", slog.String("signal", received.String()))
+		case <-done:
+		}
+		signal.Stop(signals)
+		_ = manager.Shutdown(context.Background())
+	}()
+}
+
+// Shutdown runs the hooks, within ctx, and returns their errors joined
+// only the first call runs them; later and concurrent calls wait for it and return the same error,
+// so Shutdown must not be called from a hook
+func (manager *ShutdownManager) Shutdown(ctx context.Context) error {
+	manager.once.Do(func() {
+		manager.mutex.Lock()
+		manager.started = true
+		hooks := append([]registeredHook(nil), manager.hooks...)
+		manager.mutex.Unlock()
+
+		sort.SliceStable(hooks, func(left, right int) bool {
+			if hooks[left].priority != hooks[right].priority {
+				return hooks[left].priority > hooks[right].priority
+			}
+			return hooks[left].order > hooks[right].order
+		})
+
+		var errs []error
+		for _, hook := range hooks {
+			if err := manager.runHook(ctx, hook); err != nil {
+				errs = append(errs, &ShutdownError{Name: hook.name, Err: err})
+			}
+		}
+		manager.err = errors.Join(errs...)
+		close(manager.doneChannel())
+	})
+	return manager.err
+}
+
+// Done is closed when the shutdown is complete
+func (manager *ShutdownManager) Done() <-chan struct{} {
+	return manager.doneChannel()
+}
+
+// Wait blocks until the shutdown is complete and returns the errors of the hooks
+func (manager *ShutdownManager) Wait() error {
+	<-manager.doneChannel()
+	return manager.err
+}
+
+// doneChannel is closed when the shutdown is complete; it is made on first use, so a
+// ShutdownManager literal works too
+func (manager *ShutdownManager) doneChannel() chan struct{} {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.done == nil {
+		manager.done = make(chan struct{})
+	}
+	return manager.done
+}
+
+// runHook runs hook until it returns, panics or its timeout passes
+// a hook which times out is left running, as it can not be stopped, but is no longer waited for
+func (manager *ShutdownManager) runHook(ctx context.Context, hook registeredHook) error {
+	timeout := durationOrDefault(hook.timeout, durationOrDefault(manager.Timeout, defaultHookTimeout))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	started := time.Now()
+	err := callShutdownHook(ctx, hook.run)
+	attributes := []slog.Attr{slog.String("hook", hook.name), slog.Duration("duration", time.Since(started))}
+	if err != nil {
+		manager.log(slog.LevelError, "shutdown hook failed", append(attributes, slog.String("error", err.Error()))...)
+	} else {
+		manager.log(slog.LevelInfo, "shutdown hook finished", attributes...)
+	}
+	return err
+}
+
+func (manager *ShutdownManager) log(level slog.Level, message string, attributes ...slog.Attr) {
+	if manager.tools == nil || manager.tools.Logger == nil {
+		return
+	}
+	manager.tools.Logger.LogAttrs(context.Background(), level, message, attributes...)
+}
+
+// shutdownSignals is signals, or SIGINT and SIGTERM when it is empty
+func shutdownSignals(signals []os.Signal) []os.Signal {
+	if len(signals) > 0 {
+		return signals
+	}
+	return []os.Signal{os.Interrupt, syscall.SIGTERM}
+}
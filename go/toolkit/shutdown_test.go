@@ -0,0 +1,239 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownManager_Order(test *testing.T) {
+	var testTools Tools
+	manager := testTools.NewShutdownManager()
+
+	var order []string
+	record := func(name string) ShutdownHook {
+		return func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+	manager.Register("close database", 0, 0, record("close database"))
+	manager.Register("flush logs", -10, 0, record("flush logs"))
+	manager.Register("stop cache", 0, 0, record("stop cache"))
+	manager.Register("drain queue", 10, 0, record("drain queue"))
+
+	if err := manager.Shutdown(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+	if strings.Join(order, ", ") != "drain queue, stop cache, close database, flush logs" {
+		test.Errorf("wrong order: %v", order)
+	}
+
+	// hooks run only once, and not when registered late
+	manager.Register("late", 0, 0, record("late"))
+	if err := manager.Shutdown(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+	if len(order) != 4 {
+		test.Errorf("expected hooks to run once, got %v", order)
+	}
+}
+
+func TestShutdownManager_Errors(test *testing.T) {
+	var testTools Tools
+	manager := testTools.NewShutdownManager()
+	manager.Timeout = 50 * time.Millisecond
+
+	closeErr := errors.New("connection reset")
+	ran := false
+	manager.Register("close database", 0, 0, func(ctx context.Context) error {
+		return closeErr
+	})
+	manager.Register("drain queue", 0, 0, func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return nil
+	})
+	manager.Register("flush logs", 0, time.Second, func(ctx context.Context) error {
+		panic("log file closed")
+	})
+	manager.Register("stop cache", 0, 0, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	started := time.Now()
+	err := manager.Shutdown(context.Background())
+	if time.Since(started) > 500*time.Millisecond {
+		test.Error("expected slow hook to be abandoned at its timeout")
+	}
+	if !ran {
+		test.Error("expected every hook to run despite failures")
+	}
+	if !errors.Is(err, closeErr) || !errors.Is(err, context.DeadlineExceeded) {
+		test.Errorf("expected hook errors to be joined, got %v", err)
+	}
+
+	var failed []string
+	for _, wrapped := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var shutdownError *ShutdownError
+		if errors.As(wrapped, &shutdownError) {
+			failed = append(failed, shutdownError.Name)
+		}
+	}
+	if strings.Join(failed, ", ") != "flush logs, drain queue, close database" {
+		test.Errorf("wrong failed hooks: %v", failed)
+	}
+	if !strings.Contains(err.Error(), `shutdown hook "flush logs": panic: log file closed`) {
+		test.Errorf("expected panic to be reported, got %v", err)
+	}
+	if manager.Wait() != err {
+		test.Error("expected Wait to return the shutdown error")
+	}
+}
+
+func TestShutdownManager_Concurrent(test *testing.T) {
+	var testTools Tools
+	manager := testTools.NewShutdownManager()
+
+	var mutex sync.Mutex
+	runs := 0
+	manager.Register("count", 0, 0, func(ctx context.Context) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		runs++
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+
+	var waitGroup sync.WaitGroup
+	for idx := 0; idx < 5; idx++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			_ = manager.Shutdown(context.Background())
+		}()
+	}
+	waitGroup.Wait()
+
+	select {
+	case <-manager.Done():
+	default:
+		test.Error("expected shutdown to be done")
+	}
+	if runs != 1 {
+		test.Errorf("expected hook to run once, ran %d times", runs)
+	}
+}
+
+func TestShutdownManager_Listen(test *testing.T) {
+	var testTools Tools
+	manager := testTools.NewShutdownManager()
+	// not SIGINT, which the CloseListener test has told to exit the process
+	manager.Signals = []os.Signal{syscall.SIGHUP}
+
+	ran := make(chan struct{})
+	manager.Register("close database", 0, 0, func(ctx context.Context) error {
+		close(ran)
+		return nil
+	})
+	manager.Listen()
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		test.Skip("can not signal this process: ", err)
+	}
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		test.Fatal("signal did not start the shutdown")
+	}
+	if err := manager.Wait(); err != nil {
+		test.Error(err)
+	}
+}
+
+func TestGracefulServer_Hooks(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+	server.Hooks = testTools.NewShutdownManager()
+
+	var order []string
+	server.Hooks.Register("close database", 0, 0, func(ctx context.Context) error {
+		order = append(order, "close database")
+		return nil
+	})
+	server.OnShutdown(func(ctx context.Context) error {
+		order = append(order, "server hook")
+		return nil
+	})
+
+	_, result := startGracefulServer(test, server, http.NotFoundHandler())
+	server.Stop()
+	if err := waitForResult(test, result); err != nil {
+		test.Fatal(err)
+	}
+	if strings.Join(order, ", ") != "server hook, close database" {
+		test.Errorf("wrong order: %v", order)
+	}
+}
+
+func TestShutdownManager_Literal(test *testing.T) {
+	manager := &ShutdownManager{}
+	ran := false
+	manager.Register("close database", 0, 0, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- manager.Wait()
+	}()
+	if err := manager.Shutdown(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case err := <-waited:
+		if err != nil {
+			test.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("Wait did not return after the shutdown")
+	}
+	if !ran {
+		test.Error("expected hook to run")
+	}
+}
+
+func TestGracefulServer_HooksOwnTimeout(test *testing.T) {
+	var testTools Tools
+	server := testTools.NewGracefulServer(&http.Server{})
+	server.HookTimeout = 20 * time.Millisecond
+	server.Hooks = testTools.NewShutdownManager()
+
+	server.Hooks.Register("drain queue", 0, time.Second, func(ctx context.Context) error {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	_, result := startGracefulServer(test, server, http.NotFoundHandler())
+	server.Stop()
+	if err := waitForResult(test, result); err != nil {
+		test.Errorf("expected the hook's own timeout to apply, got %v", err)
+	}
+}
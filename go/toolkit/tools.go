@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,10 +25,37 @@ const gigabyte = 1024 * 1024 * 1024
 const megabyte = 1024 * 1024
 
 type Tools struct {
-	MaxJSONSize        int
-	AllowUnknownFields bool
-	MaxFileSize        int
-	AllowedFileTypes   []string
+	MaxJSONSize                int
+	AllowUnknownFields         bool
+	ValidateJSON               bool
+	RequireJSONContentType     bool
+	ContentDecoders            map[string]ContentDecoderFunc
+	MaxJSONStreamItemSize      int
+	MaxJSONStreamItems         int
+	JSONStreamFlushEvery       int
+	Encoders                   map[string]EncoderFunc
+	CompressionThreshold       int
+	DisableResponseCompression bool
+	EnableETags                bool
+	JSONPrefix                 string
+	DisableHTMLEscape          bool
+	NoSniff                    bool
+	JSONPCallbackParameter     string
+	UseProblemJSON             bool
+	ProblemTypeBaseURI         string
+	ExposeUnknownErrors        bool
+	RequestIDHeader            string
+	Logger                     *slog.Logger
+	RemoteRetry                *RetryPolicy
+	RemoteCircuitBreaker       *CircuitBreaker
+	RemoteSigner               *WebhookSigner
+	MaxRemoteResponseSize      int
+	RemoteTokenSource          TokenSource
+	MaxFileSize                int
+	AllowedFileTypes           []string
+	CompressStaticFiles        bool
+
+	errorRules []errorRule
 }
 
 func createRandomStringSource() string {
@@ -105,12 +133,112 @@ func (tools *Tools) CreateSlug(str string) (string, error) {
 // DownloadStaticFile downloads a file and tries to force download to avoid displaying it
 // sets Content-Disposition
 // allows display name specification
+// serves a precompressed sibling (file.br, file.gz) when the client's Accept-Encoding allows it
+// and, when CompressStaticFiles is set, compresses compressible MIME types on the fly
 func (tools *Tools) DownloadStaticFile(responseWriter http.ResponseWriter, request *http.Request, pth, file, displayName string) {
 	filePath := path.Join(pth, file)
 	responseWriter.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+
+	contentType := staticContentType(filePath)
+	acceptEncoding := request.Header.Get("Accept-Encoding")
+
+	// look for precompressed siblings of the requested file
+	var offered []string
+	for _, precompressed := range precompressedEncodings {
+		if info, err := os.Stat(filePath + precompressed.extension); err == nil && !info.IsDir() {
+			offered = append(offered, precompressed.encoding)
+		}
+	}
+	if len(offered) > 0 {
+		responseWriter.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	if encoding := negotiateEncoding(acceptEncoding, offered); encoding != "" {
+		for _, precompressed := range precompressedEncodings {
+			if precompressed.encoding == encoding {
+				tools.serveEncodedFile(responseWriter, request, filePath+precompressed.extension, displayName, contentType, encoding)
+				return
+			}
+		}
+	}
+
+	if tools.CompressStaticFiles && isCompressible(contentType) {
+		if len(offered) == 0 {
+			responseWriter.Header().Add("Vary", "Accept-Encoding")
+		}
+		if encoding := negotiateEncoding(acceptEncoding, onTheFlyEncodings); encoding != "" {
+			tools.compressFile(responseWriter, request, filePath, contentType, encoding)
+			return
+		}
+	}
+
 	http.ServeFile(responseWriter, request, filePath)
 }
 
+// serveEncodedFile serves an already compressed file with the content type of the original
+func (tools *Tools) serveEncodedFile(responseWriter http.ResponseWriter, request *http.Request, filePath, displayName, contentType, encoding string) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.Error(responseWriter, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the compressed bytes must not be sniffed, so fall back to a generic type
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	responseWriter.Header().Set("Content-Type", contentType)
+	responseWriter.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(responseWriter, request, displayName, info.ModTime(), file)
+}
+
+// compressFile streams filePath to the client through the encoder for encoding
+// ranges are not supported on the fly, so the full representation is always sent, unless the
+// request's If-Modified-Since shows the client already has it, when it gets 304 Not Modified
+func (tools *Tools) compressFile(responseWriter http.ResponseWriter, request *http.Request, filePath, contentType, encoding string) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.Error(responseWriter, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(responseWriter, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", contentType)
+	responseWriter.Header().Set("Content-Encoding", encoding)
+	responseWriter.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	responseWriter.Header().Del("Content-Length")
+	if notModified(request, responseWriter.Header()) {
+		responseWriter.Header().Del("Content-Type")
+		responseWriter.Header().Del("Content-Encoding")
+		responseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusOK)
+	if request.Method == http.MethodHead {
+		return
+	}
+
+	compressor, err := newCompressionWriter(responseWriter, encoding)
+	if err != nil {
+		return
+	}
+	defer compressor.Close()
+	_, _ = io.Copy(compressor, file)
+}
+
 // UploadOneFile handles a single file passed in multipart form request
 func (tools *Tools) UploadOneFile(request *http.Request, uploadDirectory string, rename ...bool) (*UploadedFile, error) {
 	renameFile := true
@@ -227,78 +355,84 @@ func (tools *Tools) UploadFiles(request *http.Request, uploadDirectory string, r
 
 // JSONResponse is Type used for sending JSON
 type JSONResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+	Error     bool        `json:"error"`
+	Message   string      `json:"message"`
+	Code      string      `json:"code,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
 }
 
 // ReadJSON tries to read the body of a request and converts from json into a go data variable
+// decoding failures are returned as *JSONError
+// a leading UTF-8 byte order mark is ignored
+// gzip and deflate bodies (plus any ContentDecoders) are decompressed, with MaxJSONSize applying
+// to the decompressed size so compression bombs are bounded
+// when RequireJSONContentType is set, bodies which are not application/json (or +json) in UTF-8
+// are rejected with a JSONError which ErrorJSON sends as 415 Unsupported Media Type
+// once decoded, data is validated against its `validate` struct tags (see ValidateStruct) when
+// ValidateJSON is set; it is off by default, as other validation libraries, such as
+// go-playground/validator, read the same tag with rules ValidateStruct does not know
 func (tools *Tools) ReadJSON(responseWriter http.ResponseWriter, request *http.Request, data interface{}) error {
 	maxBytes := megabyte // one megabyte
 	if tools.MaxJSONSize != 0 {
 		maxBytes = tools.MaxJSONSize
 	}
 
-	request.Body = http.MaxBytesReader(responseWriter, request.Body, int64(maxBytes))
-
-	jsonDecoder := json.NewDecoder(request.Body)
-
-	if !tools.AllowUnknownFields {
-		jsonDecoder.DisallowUnknownFields()
+	if tools.RequireJSONContentType {
+		if err := checkJSONContentType(request.Header.Get("Content-Type")); err != nil {
+			return err
+		}
 	}
 
-	err := jsonDecoder.Decode(data)
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, int64(maxBytes))
 
+	// undo any Content-Encoding, applying the same limit to the decompressed body
+	body, closeBody, err := decompressBody(request.Body, request.Header.Get("Content-Encoding"), tools.ContentDecoders, int64(maxBytes))
 	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
-
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
-		default:
-			return err
-		}
+		return err
 	}
+	defer closeBody()
 
-	err = jsonDecoder.Decode(&struct{}{})
-
-	if err != io.EOF {
-		return errors.New("body must contain only one JSON value")
+	err = decodeJSON(body, data, jsonDecodeOptions{
+		maxBytes:           int64(maxBytes),
+		allowUnknownFields: tools.AllowUnknownFields,
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if !tools.ValidateJSON {
+		return nil
+	}
+	// check any `validate` struct tags now the data is populated
+	return tools.ValidateStruct(data)
 }
 
 // WriteJSON accepts a response status code and arbitrary data and writes JSON to the client
+// JSONPrefix (for example XSSIPrefix) is written before the JSON, HTML characters are escaped unless
+// DisableHTMLEscape is set, and NoSniff adds X-Content-Type-Options: nosniff
+// WriteResponse is the request aware alternative, adding negotiation, compression and conditional GET support
 func (tools *Tools) WriteJSON(responseWriter http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
-	output, err := json.Marshal(data)
+	return tools.writeJSONAs(responseWriter, status, data, "application/json", headers...)
+}
+
+// writeJSONAs implements WriteJSON for any JSON based content type
+func (tools *Tools) writeJSONAs(responseWriter http.ResponseWriter, status int, data interface{}, contentType string, headers ...http.Header) error {
+	output, err := tools.marshalJSON(data, false)
 	if err != nil {
 		return err
 	}
+	output = append([]byte(tools.JSONPrefix), output...)
+
 	if len(headers) > 0 {
 		for key, value := range headers[0] {
 			responseWriter.Header()[key] = value
 		}
 	}
-	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Content-Type", contentType)
+	if tools.NoSniff {
+		responseWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	}
 	responseWriter.WriteHeader(status)
 	_, err = responseWriter.Write(output)
 	if err != nil {
@@ -309,22 +443,82 @@ func (tools *Tools) WriteJSON(responseWriter http.ResponseWriter, status int, da
 
 // ErrorJSON takes an error and optionally a status code
 // generates and sends a JSON error message
+// errors with a StatusCode method (JSONError, ValidationErrors) set the default status
+// JSONError, JSONStreamError and ValidationErrors are sent as the data of the response
+// errors registered with RegisterError or RegisterErrorType use their mapped status, message and code
+// any other error is sent as a 500 with a generic message, unless the status given is a 4xx or
+// ExposeUnknownErrors is set, when its own text is sent, with a 400 status if none is given
+// the response carries a request ID, from the RequestID middleware or generated, in its body and
+// RequestIDHeader, and the full error is logged with it when a Logger is set
+// when UseProblemJSON is set the error is sent as an RFC 7807 problem instead (see ProblemJSON)
 func (tools *Tools) ErrorJSON(responseWriter http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
+	return tools.ErrorJSONForRequest(responseWriter, nil, err, status...)
+}
 
-	if len(status) > 0 {
-		statusCode = status[0]
+// ErrorJSONForRequest is ErrorJSON for handlers which are not behind the RequestID middleware:
+// the request ID of request, from its RequestIDHeader, is used rather than a new one, and the
+// error is logged with request's context
+func (tools *Tools) ErrorJSONForRequest(responseWriter http.ResponseWriter, request *http.Request, err error, status ...int) error {
+	if tools.UseProblemJSON {
+		return tools.ProblemJSONForRequest(responseWriter, request, err, status...)
 	}
 
+	resolved := tools.resolveError(err, status...)
+	requestID := tools.errorRequestID(responseWriter, request)
+	tools.logError(request, err, resolved.status, requestID)
+
 	var payload JSONResponse
 	payload.Error = true
-	payload.Message = err.Error()
+	payload.Message = resolved.message
+	payload.Code = resolved.code
+	payload.RequestID = requestID
+	if !resolved.masked {
+		payload.Data = errorDetail(err)
+	}
+
+	return tools.WriteJSON(responseWriter, resolved.status, payload)
+}
+
+// errorStatus is the explicit status if one was given, else the error's own StatusCode, else 400
+func errorStatus(err error, status ...int) int {
+	if len(status) > 0 {
+		return status[0]
+	}
+
+	var coder interface{ StatusCode() int }
+	if errors.As(err, &coder) {
+		return coder.StatusCode()
+	}
+	return http.StatusBadRequest
+}
 
-	return tools.WriteJSON(responseWriter, statusCode, payload)
+// errorDetail returns the structured detail of the toolkit's typed errors, or nil
+func errorDetail(err error) interface{} {
+	var streamError *JSONStreamError
+	var validationErrors ValidationErrors
+	var jsonError *JSONError
+	switch {
+	case errors.As(err, &streamError):
+		return streamError
+	case errors.As(err, &validationErrors):
+		return validationErrors
+	case errors.As(err, &jsonError):
+		return jsonError
+	}
+	return nil
 }
 
 // SendJSONToRemote expects standard url.URL, arbitrary data, and an optional http Client
 // If no http client is specified, standard http.Client is used
+// the returned response's body has already been read and closed, but can be read again, and
+// ReadRemoteJSON can decode it; bodies larger than MaxRemoteResponseSize (default 10 megabytes)
+// are returned as a *ResponseError
+// when RemoteRetry is set, failed calls are retried as it describes
+// when RemoteCircuitBreaker is set, calls to a failing host return a *CircuitOpenError without being sent
+// when RemoteTokenSource is set, its token is sent in the Authorization header, and a call rejected
+// with 401 Unauthorized is made once more with a new token
+// when RemoteSigner is set, the body is signed so webhook receivers can check it with VerifyWebhook
+// use JSONClient for other methods, shared settings and decoded replies
 func (tools *Tools) PostJSONToRemote(uri url.URL, data interface{}, client ...*http.Client) (*http.Response, int, error) {
 	// create JSON
 	jsonData, err := json.Marshal(data)
@@ -339,7 +533,7 @@ func (tools *Tools) PostJSONToRemote(uri url.URL, data interface{}, client ...*h
 	}
 
 	// build request
-	request, err := http.NewRequest("POST", uri.String(), bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("POST", uri.String(), bytes.NewReader(jsonData))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -347,21 +541,41 @@ func (tools *Tools) PostJSONToRemote(uri url.URL, data interface{}, client ...*h
 	// set header
 	request.Header.Set("Content-Type", "application/json")
 
-	// call remote URI
-	response, err := httpClient.Do(request)
+	// call remote URI, authenticating with RemoteTokenSource, retrying if RemoteRetry is set,
+	// failing fast while RemoteCircuitBreaker is open and signing each attempt with RemoteSigner
+	response, err := sendWithToken(httpClient, request, tools.RemoteTokenSource, tools.RemoteRetry, tools.RemoteCircuitBreaker, tools.RemoteSigner)
 	if err != nil {
 		return nil, 0, err
 	}
-	defer response.Body.Close()
+	if _, err := readResponseBody(response, int64(tools.MaxRemoteResponseSize)); err != nil {
+		return nil, 0, newResponseError(response, err)
+	}
 
 	// send response back
 	return response, response.StatusCode, nil
 }
 
+// ReadRemoteJSON decodes the body of a response returned by PostJSONToRemote into data
+// the response must be application/json (or +json) in UTF-8, and its body is decoded as ReadJSON
+// decodes request bodies, honoring AllowUnknownFields; failures are returned as a *ResponseError
+// wrapping a *JSONError
+func (tools *Tools) ReadRemoteJSON(response *http.Response, data interface{}) error {
+	responseBody, err := readResponseBody(response, int64(tools.MaxRemoteResponseSize))
+	if err != nil {
+		return newResponseError(response, err)
+	}
+	if err := decodeResponseJSON(response, responseBody, data, int64(tools.MaxRemoteResponseSize), tools.AllowUnknownFields, true); err != nil {
+		return newResponseError(response, err)
+	}
+	return nil
+}
+
 /*
 	CloseListener creates a 'listener' on a new goroutine which will notify the
 	program if it receives an interrupt from the OS. We could then handle this by calling
 	a "clean up procedure" and exiting the program.
+	To shut an http.Server down gracefully instead, use NewGracefulServer, and to run
+	several cleanup steps in order, NewShutdownManager.
 */
 // ExitHandlerFunc should levearge os.Exit()
 // expect function signature with error and optional array of strings
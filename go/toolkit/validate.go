@@ -0,0 +1,353 @@
+package toolkit
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError describes a single field which failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the list of every field which failed validation
+// ErrorJSON renders it as a 422 response with the field errors as data
+type ValidationErrors []FieldError
+
+func (validationErrors ValidationErrors) Error() string {
+	messages := make([]string, len(validationErrors))
+	for idx, fieldError := range validationErrors {
+		messages[idx] = fieldError.Message
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// StatusCode is the HTTP status ErrorJSON uses for the error when none is given
+func (validationErrors ValidationErrors) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// ValidationTagError reports a malformed `validate` tag, such as an unknown rule or a rule which can
+// not apply to the field's type; it is a mistake in the program rather than the request, so ErrorJSON
+// masks it as a 500, as it does unknown errors, whatever status it is given
+type ValidationTagError struct {
+	Field   string
+	Message string
+}
+
+func (tagError *ValidationTagError) Error() string {
+	return tagError.Message
+}
+
+// StatusCode is the HTTP status ErrorJSON uses for the error
+func (tagError *ValidationTagError) StatusCode() int {
+	return http.StatusInternalServerError
+}
+
+func (tagError *ValidationTagError) internalError() {}
+
+// newTagError builds a ValidationTagError for the field at path
+func newTagError(path, format string, args ...interface{}) error {
+	return &ValidationTagError{Field: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// validationRule is one rule of a `validate` tag
+type validationRule struct {
+	name  string
+	param string
+}
+
+// compiled regexp rules are cached as tags are static for the life of the program
+var validationPatterns sync.Map
+
+// ValidateStruct checks data against the rules in its `validate` struct tags
+// ReadJSON and the JSON stream readers call it when ValidateJSON is set; leave that off if another
+// library's rules, such as go-playground/validator's gte or dive, share the tag, as they are reported
+// here as a *ValidationTagError
+// rules are comma separated; regexp must be the last rule as its pattern may contain commas
+//
+//	Name  string `json:"name" validate:"required,min=2,max=50"`
+//	Email string `json:"email" validate:"required,email"`
+//	Role  string `json:"role" validate:"oneof=admin user guest"`
+//	Code  string `json:"code" validate:"len=6,regexp=^[A-Z0-9]+$"`
+//
+// every rule applies to zero values too, so an empty Role above fails oneof; omitempty makes a field
+// optional, skipping the other rules when it holds its zero value, and a nil pointer is only checked
+// by required, as it was not sent
+//
+//	Website string `json:"website" validate:"omitempty,url"`
+//
+// nested structs, pointers to structs and slices of structs are validated recursively
+// returns ValidationErrors when any field fails, or a *ValidationTagError when a tag is malformed
+func (tools *Tools) ValidateStruct(data interface{}) error {
+	var validationErrors ValidationErrors
+	if err := validateValue(reflect.ValueOf(data), "", &validationErrors); err != nil {
+		return err
+	}
+	if len(validationErrors) > 0 {
+		return validationErrors
+	}
+	return nil
+}
+
+// validateValue walks value looking for structs to validate
+func validateValue(value reflect.Value, path string, validationErrors *ValidationErrors) error {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		return validateStruct(value, path, validationErrors)
+	case reflect.Slice, reflect.Array:
+		for idx := 0; idx < value.Len(); idx++ {
+			if err := validateValue(value.Index(idx), fmt.Sprintf("%s[%d]", path, idx), validationErrors); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateStruct applies the rules of each exported field and then descends into it
+func validateStruct(value reflect.Value, path string, validationErrors *ValidationErrors) error {
+	valueType := value.Type()
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		structField := valueType.Field(idx)
+		if !structField.IsExported() {
+			continue
+		}
+
+		fieldPath := fieldName(structField)
+		if fieldPath == "-" {
+			continue
+		}
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		fieldValue := value.Field(idx)
+		if tag, ok := structField.Tag.Lookup("validate"); ok && tag != "" {
+			if err := validateField(fieldValue, fieldPath, tag, validationErrors); err != nil {
+				return err
+			}
+		}
+
+		if err := validateValue(fieldValue, fieldPath, validationErrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldName uses the json name of a field so errors match what the client sent
+func fieldName(structField reflect.StructField) string {
+	name, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+	if name == "" {
+		return structField.Name
+	}
+	return name
+}
+
+// validateField runs every rule in tag against a single field
+func validateField(value reflect.Value, path, tag string, validationErrors *ValidationErrors) error {
+	rules, err := parseValidationTag(path, tag)
+	if err != nil {
+		return err
+	}
+
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			break
+		}
+		value = value.Elem()
+	}
+	empty := value.IsZero()
+	absent := (value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface) && value.IsNil()
+
+	optional := false
+	for _, rule := range rules {
+		if rule.name == "omitempty" {
+			optional = true
+		}
+	}
+
+	for _, rule := range rules {
+		switch {
+		case rule.name == "omitempty":
+			continue
+		case rule.name == "required":
+			if empty {
+				*validationErrors = append(*validationErrors, FieldError{Field: path, Rule: rule.name, Message: path + " is required"})
+				// the other rules would only repeat that the field is missing
+				return nil
+			}
+			continue
+		case absent || (optional && empty):
+			continue
+		}
+
+		message, err := checkRule(value, path, rule.name, rule.param)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			*validationErrors = append(*validationErrors, FieldError{Field: path, Rule: rule.name, Param: rule.param, Message: message})
+		}
+	}
+	return nil
+}
+
+// parseValidationTag splits tag into its rules, checking each is known and has a usable parameter,
+// so a malformed tag is reported whatever the field holds
+func parseValidationTag(path, tag string) ([]validationRule, error) {
+	var rules []validationRule
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regexp=") {
+			rule, tag = tag, ""
+		} else {
+			rule, tag, _ = strings.Cut(tag, ",")
+		}
+		name, param, _ := strings.Cut(strings.TrimSpace(rule), "=")
+
+		switch name {
+		case "required", "omitempty", "email", "url", "oneof":
+		case "min", "max", "len":
+			if _, err := strconv.ParseFloat(param, 64); err != nil {
+				return nil, newTagError(path, "invalid %s parameter %q for field %s", name, param, path)
+			}
+		case "regexp":
+			if _, err := compileValidationPattern(param); err != nil {
+				return nil, newTagError(path, "invalid regexp for field %s: %v", path, err)
+			}
+		default:
+			return nil, newTagError(path, "unknown validation rule %q on field %s", name, path)
+		}
+		rules = append(rules, validationRule{name: name, param: param})
+	}
+	return rules, nil
+}
+
+// checkRule returns a message describing the failure, or an empty string if value satisfies the rule
+func checkRule(value reflect.Value, path, name, param string) (string, error) {
+	switch name {
+	case "min", "max", "len":
+		return checkBound(value, path, name, param)
+	case "oneof":
+		actual := fmt.Sprint(value.Interface())
+		options := strings.Fields(param)
+		for _, option := range options {
+			if actual == option {
+				return "", nil
+			}
+		}
+		return fmt.Sprintf("%s must be one of: %s", path, strings.Join(options, ", ")), nil
+	case "email":
+		if value.Kind() != reflect.String {
+			return "", newTagError(path, "validation rule email cannot be applied to field %s", path)
+		}
+		address, err := mail.ParseAddress(value.String())
+		if err != nil || address.Address != value.String() {
+			return path + " must be a valid email address", nil
+		}
+		return "", nil
+	case "url":
+		if value.Kind() != reflect.String {
+			return "", newTagError(path, "validation rule url cannot be applied to field %s", path)
+		}
+		parsed, err := url.ParseRequestURI(value.String())
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return path + " must be a valid URL", nil
+		}
+		return "", nil
+	case "regexp":
+		if value.Kind() != reflect.String {
+			return "", newTagError(path, "validation rule regexp cannot be applied to field %s", path)
+		}
+		pattern, err := compileValidationPattern(param)
+		if err != nil {
+			return "", newTagError(path, "invalid regexp for field %s: %v", path, err)
+		}
+		if !pattern.MatchString(value.String()) {
+			return fmt.Sprintf("%s must match the pattern %s", path, param), nil
+		}
+		return "", nil
+	default:
+		return "", newTagError(path, "unknown validation rule %q on field %s", name, path)
+	}
+}
+
+// checkBound compares numbers by value and strings, slices and maps by length
+func checkBound(value reflect.Value, path, name, param string) (string, error) {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return "", newTagError(path, "invalid %s parameter %q for field %s", name, param, path)
+	}
+
+	var actual float64
+	unit := ""
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		actual = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		actual = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = value.Float()
+	case reflect.String:
+		actual, unit = float64(utf8.RuneCountInString(value.String())), " characters long"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		actual, unit = float64(value.Len()), " items"
+	default:
+		return "", newTagError(path, "validation rule %s cannot be applied to field %s", name, path)
+	}
+	if name == "len" && unit == "" {
+		return "", newTagError(path, "validation rule len cannot be applied to field %s", path)
+	}
+
+	switch {
+	case name == "min" && actual < limit:
+		if unit == " items" {
+			return fmt.Sprintf("%s must contain at least %s items", path, param), nil
+		}
+		return fmt.Sprintf("%s must be at least %s%s", path, param, unit), nil
+	case name == "max" && actual > limit:
+		if unit == " items" {
+			return fmt.Sprintf("%s must contain at most %s items", path, param), nil
+		}
+		return fmt.Sprintf("%s must be at most %s%s", path, param, unit), nil
+	case name == "len" && actual != limit:
+		if unit == " items" {
+			return fmt.Sprintf("%s must contain exactly %s items", path, param), nil
+		}
+		return fmt.Sprintf("%s must be exactly %s%s", path, param, unit), nil
+	}
+	return "", nil
+}
+
+// compileValidationPattern compiles a regexp rule once and caches it
+func compileValidationPattern(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := validationPatterns.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	validationPatterns.Store(pattern, compiled)
+	return compiled, nil
+}
@@ -0,0 +1,186 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type validationAddress struct {
+	City     string `json:"city" validate:"required"`
+	Postcode string `json:"postcode" validate:"omitempty,regexp=^[0-9]{5}$"`
+}
+
+type validationTarget struct {
+	Name     string              `json:"name" validate:"required,min=2,max=10"`
+	Email    string              `json:"email" validate:"required,email"`
+	Website  string              `json:"website" validate:"omitempty,url"`
+	Role     string              `json:"role" validate:"omitempty,oneof=admin user"`
+	Age      int                 `json:"age" validate:"omitempty,min=18,max=130"`
+	Code     string              `json:"code" validate:"omitempty,len=3"`
+	Tags     []string            `json:"tags" validate:"max=2"`
+	Nickname *string             `json:"nickname" validate:"required"`
+	Address  *validationAddress  `json:"address"`
+	Previous []validationAddress `json:"previous"`
+}
+
+var validationTests = []struct {
+	name           string
+	json           string
+	expectedFields []string
+}{
+	{name: "valid", json: `{"name":"jake","email":"jake@example.com","website":"https://example.com","role":"admin","age":30,"code":"abc","tags":["a"],"nickname":"j","address":{"city":"x","postcode":"12345"}}`, expectedFields: nil},
+	{name: "missing required", json: `{}`, expectedFields: []string{"name", "email", "nickname"}},
+	{name: "too short and too young", json: `{"name":"j","email":"jake@example.com","age":12,"nickname":"j"}`, expectedFields: []string{"name", "age"}},
+	{name: "bad formats", json: `{"name":"jake","email":"not-an-email","website":"example","role":"root","code":"abcd","nickname":"j"}`, expectedFields: []string{"email", "website", "role", "code"}},
+	{name: "too many items", json: `{"name":"jake","email":"jake@example.com","tags":["a","b","c"],"nickname":"j"}`, expectedFields: []string{"tags"}},
+	{name: "nested", json: `{"name":"jake","email":"jake@example.com","nickname":"j","address":{"postcode":"abc"},"previous":[{"city":"y"},{"postcode":"1"}]}`, expectedFields: []string{"address.city", "address.postcode", "previous[1].city", "previous[1].postcode"}},
+}
+
+func TestTools_ValidateStruct(test *testing.T) {
+	testTools := Tools{ValidateJSON: true}
+
+	for _, entry := range validationTests {
+		var target validationTarget
+		request := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		err := testTools.ReadJSON(httptest.NewRecorder(), request, &target)
+
+		if len(entry.expectedFields) == 0 {
+			if err != nil {
+				test.Errorf("%s: error not expected, but one received: %s", entry.name, err.Error())
+			}
+			continue
+		}
+
+		var validationErrors ValidationErrors
+		if !errors.As(err, &validationErrors) {
+			test.Errorf("%s: expected ValidationErrors but got %v", entry.name, err)
+			continue
+		}
+		if len(validationErrors) != len(entry.expectedFields) {
+			test.Errorf("%s: expected %d field errors but got %d: %v", entry.name, len(entry.expectedFields), len(validationErrors), validationErrors)
+			continue
+		}
+		for idx, field := range entry.expectedFields {
+			if validationErrors[idx].Field != field {
+				test.Errorf("%s: expected error for field %s but got %s", entry.name, field, validationErrors[idx].Field)
+			}
+		}
+	}
+}
+
+func TestTools_ReadJSONWithoutValidation(test *testing.T) {
+	var testTools Tools
+	var target struct {
+		Age int `json:"age" validate:"gte=18"`
+	}
+
+	// rules meant for another library are left alone unless ValidateJSON is set
+	request := httptest.NewRequest("POST", "/", strings.NewReader(`{"age":30}`))
+	if err := testTools.ReadJSON(httptest.NewRecorder(), request, &target); err != nil || target.Age != 30 {
+		test.Errorf("expected the body to be read without validation but got %v", err)
+	}
+
+	testTools.ValidateJSON = true
+	request = httptest.NewRequest("POST", "/", strings.NewReader(`{"age":30}`))
+	var tagError *ValidationTagError
+	if err := testTools.ReadJSON(httptest.NewRecorder(), request, &target); !errors.As(err, &tagError) {
+		test.Errorf("expected a ValidationTagError with ValidateJSON set but got %v", err)
+	}
+}
+
+func TestTools_ValidateStructZeroValues(test *testing.T) {
+	var testTools Tools
+	var target struct {
+		Count    int     `json:"count" validate:"min=1"`
+		Level    string  `json:"level" validate:"oneof=low high"`
+		Note     string  `json:"note" validate:"omitempty,min=3"`
+		Limit    *int    `json:"limit" validate:"min=1"`
+		Password string  `json:"password" validate:"required,min=8"`
+		Ratio    float64 `json:"ratio" validate:"max=1"`
+	}
+
+	err := testTools.ValidateStruct(&target)
+	var validationErrors ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		test.Fatalf("expected ValidationErrors but got %v", err)
+	}
+	var failed []string
+	for _, fieldError := range validationErrors {
+		failed = append(failed, fieldError.Field+":"+fieldError.Rule)
+	}
+	if strings.Join(failed, ", ") != "count:min, level:oneof, password:required" {
+		test.Errorf("unexpected field errors %v", failed)
+	}
+}
+
+var badTagTests = []struct {
+	name  string
+	value interface{}
+}{
+	{name: "unknown rule", value: &struct {
+		Name string `validate:"shiny"`
+	}{Name: "x"}},
+	{name: "unknown rule on empty field", value: &struct {
+		Name string `validate:"omitempty,shiny"`
+	}{}},
+	{name: "bad bound", value: &struct {
+		Age int `validate:"min=ten"`
+	}{}},
+	{name: "bad regexp", value: &struct {
+		Code string `validate:"regexp=[a-"`
+	}{}},
+	{name: "wrong type", value: &struct {
+		Age int `validate:"email"`
+	}{}},
+}
+
+func TestTools_ValidateStructBadTag(test *testing.T) {
+	var testTools Tools
+
+	for _, entry := range badTagTests {
+		err := testTools.ValidateStruct(entry.value)
+		var tagError *ValidationTagError
+		if !errors.As(err, &tagError) {
+			test.Errorf("%s: expected a ValidationTagError but got %v", entry.name, err)
+			continue
+		}
+
+		// the tag is the program's mistake, so it is masked even when the caller blames the client
+		responseRecorder := httptest.NewRecorder()
+		_ = testTools.ErrorJSON(responseRecorder, err, http.StatusBadRequest)
+		if responseRecorder.Code != http.StatusInternalServerError || strings.Contains(responseRecorder.Body.String(), "field") {
+			test.Errorf("%s: expected a masked 500 but got %d %s", entry.name, responseRecorder.Code, responseRecorder.Body.String())
+		}
+	}
+}
+
+func TestTools_ErrorJSONValidation(test *testing.T) {
+	var testTools Tools
+	responseRecorder := httptest.NewRecorder()
+
+	err := testTools.ErrorJSON(responseRecorder, ValidationErrors{{Field: "name", Rule: "required", Message: "name is required"}})
+	if err != nil {
+		test.Error(err)
+	}
+
+	if responseRecorder.Code != http.StatusUnprocessableEntity {
+		test.Errorf("wrong status code returned; expected 422, but got %d", responseRecorder.Code)
+	}
+
+	var payload struct {
+		Error bool         `json:"error"`
+		Data  []FieldError `json:"data"`
+	}
+	err = json.NewDecoder(responseRecorder.Body).Decode(&payload)
+	if err != nil {
+		test.Error("received error when decoding JSON", err)
+	}
+	if !payload.Error || len(payload.Data) != 1 || payload.Data[0].Field != "name" {
+		test.Errorf("unexpected payload %+v", payload)
+	}
+}
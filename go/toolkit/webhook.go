@@ -0,0 +1,240 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWebhookSignatureHeader is the header webhook signatures are sent in when no other is configured
+const DefaultWebhookSignatureHeader = "Webhook-Signature"
+
+// default age, either way, a webhook timestamp may be from the current time
+const defaultWebhookTolerance = 5 * time.Minute
+
+// the errors VerifyWebhook and WebhookVerifier.Verify return
+var (
+	ErrWebhookSignatureMissing = errors.New("webhook signature is missing")
+	ErrWebhookSignatureInvalid = errors.New("webhook signature is invalid")
+	ErrWebhookTimestamp        = errors.New("webhook timestamp is outside the tolerance")
+	ErrWebhookReplayed         = errors.New("webhook has already been received")
+)
+
+// WebhookSigner signs outgoing webhook bodies with HMAC-SHA256
+// the signature header has the form t=<unix timestamp>,n=<nonce>,v1=<hex signature>, where the signature
+// is of the timestamp, the random nonce and the body, each followed by a full stop but the body, so a
+// captured body can not be replayed with a new timestamp, and a retry, signed afresh, is not taken
+// for a replay even within the same second; Verify rejects a signature without a nonce, or with one
+// holding a full stop, as the boundary between the nonce and the body would then be ambiguous
+type WebhookSigner struct {
+	// Secret is the key shared with the receiver
+	Secret []byte
+	// Header is the header the signature is sent in; Webhook-Signature when empty
+	Header string
+
+	now func() time.Time
+}
+
+// Signature returns the value of the signature header for body
+func (signer *WebhookSigner) Signature(body []byte) string {
+	timestamp := strconv.FormatInt(webhookClock(signer.now).Unix(), 10)
+	nonce := newIdempotencyKey()
+	return "t=" + timestamp + ",n=" + nonce + ",v1=" + signWebhook(signer.Secret, timestamp, nonce, body)
+}
+
+// SignRequest sets the signature header of request, whose body must be replayable with GetBody
+// JSONClient and PostJSONToRemote call it before each attempt, so every retry has a fresh signature
+func (signer *WebhookSigner) SignRequest(request *http.Request) error {
+	var body []byte
+	if request.GetBody != nil {
+		reader, err := request.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+	} else if request.Body != nil && request.Body != http.NoBody {
+		return errors.New("request body can not be read for signing")
+	}
+
+	request.Header.Set(webhookHeader(signer.Header), signer.Signature(body))
+	return nil
+}
+
+// ReplayStore remembers webhook signatures which have been received
+// the default is an in memory store; use a shared store when several instances receive webhooks
+type ReplayStore interface {
+	// Remember records key until expires, reporting false if it was already recorded
+	Remember(key string, expires time.Time) (bool, error)
+}
+
+// memoryReplayStore is a ReplayStore for a single process
+type memoryReplayStore struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+func (store *memoryReplayStore) Remember(key string, expires time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	if store.seen == nil {
+		store.seen = make(map[string]time.Time)
+	}
+	for seenKey, seenExpires := range store.seen {
+		if now.After(seenExpires) {
+			delete(store.seen, seenKey)
+		}
+	}
+	if _, ok := store.seen[key]; ok {
+		return false, nil
+	}
+	store.seen[key] = expires
+	return true, nil
+}
+
+// WebhookVerifier checks the signatures WebhookSigner makes on incoming webhooks
+type WebhookVerifier struct {
+	// Secrets are the keys a signature may be made with; list the old and new key while rotating
+	Secrets [][]byte
+	// Header is the header the signature is read from; Webhook-Signature when empty
+	Header string
+	// Tolerance is how far, either way, the signed timestamp may be from now; 5 minutes when zero
+	Tolerance time.Duration
+	// ReplayStore remembers accepted signatures so a webhook can only be received once; in memory when nil
+	ReplayStore ReplayStore
+	// DisableReplayCheck accepts webhooks which have been received before
+	DisableReplayCheck bool
+
+	defaultStore memoryReplayStore
+	now          func() time.Time
+}
+
+// Verify checks a signature header against body
+func (verifier *WebhookVerifier) Verify(signature string, body []byte) error {
+	if signature == "" {
+		return ErrWebhookSignatureMissing
+	}
+
+	var timestamp, nonce string
+	var signatures []string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "n":
+			nonce = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || strings.Contains(nonce, ".") || len(signatures) == 0 {
+		return ErrWebhookSignatureInvalid
+	}
+
+	matched := ""
+	for _, secret := range verifier.Secrets {
+		expected := signWebhook(secret, timestamp, nonce, body)
+		for _, candidate := range signatures {
+			if hmac.Equal([]byte(expected), []byte(candidate)) {
+				matched = candidate
+			}
+		}
+	}
+	if matched == "" {
+		return ErrWebhookSignatureInvalid
+	}
+
+	tolerance := verifier.Tolerance
+	if tolerance <= 0 {
+		tolerance = defaultWebhookTolerance
+	}
+	signedAt := time.Unix(seconds, 0)
+	age := webhookClock(verifier.now).Sub(signedAt)
+	if age > tolerance || age < -tolerance {
+		return ErrWebhookTimestamp
+	}
+
+	if verifier.DisableReplayCheck {
+		return nil
+	}
+	var store ReplayStore = &verifier.defaultStore
+	if verifier.ReplayStore != nil {
+		store = verifier.ReplayStore
+	}
+	first, err := store.Remember(matched, signedAt.Add(tolerance))
+	if err != nil {
+		return err
+	}
+	if !first {
+		return ErrWebhookReplayed
+	}
+	return nil
+}
+
+// VerifyWebhook is middleware which rejects webhooks whose signature does not verify
+// the body, limited to MaxJSONSize, is checked and then put back on the request, so next can
+// decode it with ReadJSON; failures are sent with ErrorJSON as 401 Unauthorized, or 413 Request
+// Entity Too Large when the body is over the limit
+func (tools *Tools) VerifyWebhook(verifier *WebhookVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		maxBytes := megabyte
+		if tools.MaxJSONSize != 0 {
+			maxBytes = tools.MaxJSONSize
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(responseWriter, request.Body, int64(maxBytes)))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				err = tooLargeError(err, int64(maxBytes))
+			}
+			_ = tools.ErrorJSONForRequest(responseWriter, request, err)
+			return
+		}
+
+		if err := verifier.Verify(request.Header.Get(webhookHeader(verifier.Header)), body); err != nil {
+			_ = tools.ErrorJSONForRequest(responseWriter, request, err, http.StatusUnauthorized)
+			return
+		}
+
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(responseWriter, request)
+	})
+}
+
+// signWebhook is the hex HMAC-SHA256 of the timestamp, the nonce and the body
+func signWebhook(secret []byte, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookHeader is the configured signature header, or DefaultWebhookSignatureHeader
+func webhookHeader(header string) string {
+	if header == "" {
+		return DefaultWebhookSignatureHeader
+	}
+	return header
+}
+
+func webhookClock(now func() time.Time) time.Time {
+	if now != nil {
+		return now()
+	}
+	return time.Now()
+}
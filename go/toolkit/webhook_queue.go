@@ -0,0 +1,499 @@
+package toolkit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// name of the append-only log a WebhookDispatcher keeps in its directory
+const webhookQueueFile = "webhooks.log"
+
+// webhook dispatcher defaults, used for fields left at zero
+const (
+	defaultWebhookWorkers        = 4
+	defaultWebhookAttempts       = 8
+	defaultWebhookInitialBackoff = time.Second
+	defaultWebhookMaxBackoff     = time.Hour
+	defaultWebhookTimeout        = 10 * time.Second
+)
+
+// the log is compacted once this many records have been appended since it last was, and they
+// outnumber the deliveries it holds by two to one
+const webhookCompactRecords = 1000
+
+// DeliveryStatus is where a webhook delivery is in its life
+type DeliveryStatus string
+
+const (
+	// DeliveryPending deliveries are waiting for their next attempt
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered deliveries were accepted with a 2xx status
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead deliveries failed permanently and wait in the dead letter store to be replayed
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// ErrDeliveryNotFound is returned when no delivery has the given ID
+var ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+// DeliveryAttempt records one attempt to deliver a webhook
+type DeliveryAttempt struct {
+	At         time.Time     `json:"at"`
+	Duration   time.Duration `json:"duration"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// WebhookDelivery is a webhook payload and the history of delivering it
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    DeliveryStatus  `json:"status"`
+	CreatedAt time.Time       `json:"created_at"`
+	// NextAttemptAt is when a pending delivery is next tried
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	// Failures counts failed attempts since the delivery was enqueued or last replayed
+	Failures int               `json:"failures"`
+	Attempts []DeliveryAttempt `json:"attempts,omitempty"`
+}
+
+// WebhookDispatcher delivers webhooks with PostJSONToRemote from a durable queue
+// every change to a delivery is appended to a log in its directory and synced before it is acted on, so
+// deliveries survive a restart; delivery is at least once, as a webhook sent just before a crash is
+// sent again when the dispatcher reopens, as is one whose outcome could not be written to the log
+// the log is compacted as it grows, and delivered webhooks are then forgotten
+// failed deliveries are retried with exponential backoff until MaxAttempts, or at once for a 4xx status
+// other than 408 and 429, after which they are moved to the dead letter store to be replayed
+// Tools' RemoteSigner and RemoteCircuitBreaker apply to every attempt; leave RemoteRetry unset, as
+// the dispatcher retries itself
+type WebhookDispatcher struct {
+	// Workers is the number of deliveries sent at once; 4 when zero
+	Workers int
+	// MaxAttempts is the number of attempts before a delivery is dead; 8 when zero
+	MaxAttempts int
+	// InitialBackoff is the wait after the first failure, which doubles each failure; 1 second when zero
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts; 1 hour when zero
+	MaxBackoff time.Duration
+	// HTTPClient sends the webhooks; NewWebhookDispatcher sets one with a 10 second timeout
+	HTTPClient *http.Client
+	// OnDeadLetter, if set, is called when a delivery is moved to the dead letter store
+	OnDeadLetter func(delivery WebhookDelivery)
+
+	tools      *Tools
+	directory  string
+	mutex      sync.Mutex
+	log        *os.File
+	records    int
+	deliveries map[string]*WebhookDelivery
+	inFlight   map[string]bool
+	unsaved    map[string]bool
+	wake       chan struct{}
+	cancel     context.CancelFunc
+	workers    sync.WaitGroup
+}
+
+// NewWebhookDispatcher opens the webhook queue in directory, creating it if needed, and loads
+// the deliveries it holds; call Start to begin delivering them
+func (tools *Tools) NewWebhookDispatcher(directory string) (*WebhookDispatcher, error) {
+	if err := tools.CreateDirectoryIfNotExist(directory); err != nil {
+		return nil, err
+	}
+
+	dispatcher := &WebhookDispatcher{
+		HTTPClient: &http.Client{Timeout: defaultWebhookTimeout},
+		tools:      tools,
+		directory:  directory,
+		deliveries: make(map[string]*WebhookDelivery),
+		inFlight:   make(map[string]bool),
+		unsaved:    make(map[string]bool),
+	}
+	if err := dispatcher.load(); err != nil {
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+// load rebuilds the deliveries from the log, then compacts it to the pending and dead deliveries
+func (dispatcher *WebhookDispatcher) load() error {
+	logPath := filepath.Join(dispatcher.directory, webhookQueueFile)
+	file, err := os.Open(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*megabyte)
+		for scanner.Scan() {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(scanner.Bytes(), &delivery); err != nil {
+				// a record torn by a crash while it was written; the one before it still stands
+				continue
+			}
+			dispatcher.deliveries[delivery.ID] = &delivery
+		}
+		_ = file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	return dispatcher.compact()
+}
+
+// compact writes the pending and dead deliveries to a new log and swaps it in, forgetting delivered
+// ones, so neither the log nor memory grows forever; the mutex must be held, or the workers stopped
+// it also saves the deliveries whose last change could not be persisted
+func (dispatcher *WebhookDispatcher) compact() error {
+	logPath := filepath.Join(dispatcher.directory, webhookQueueFile)
+	compactPath := logPath + ".compact"
+	compacted, err := os.OpenFile(compactPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	abandon := func(err error) error {
+		_ = compacted.Close()
+		_ = os.Remove(compactPath)
+		return err
+	}
+
+	records := 0
+	encoder := json.NewEncoder(compacted)
+	for _, delivery := range dispatcher.deliveries {
+		if delivery.Status == DeliveryDelivered {
+			continue
+		}
+		if err := encoder.Encode(delivery); err != nil {
+			return abandon(err)
+		}
+		records++
+	}
+	if err := compacted.Sync(); err != nil {
+		return abandon(err)
+	}
+	// the new log stays open for appending, so there is no moment without one
+	if err := os.Rename(compactPath, logPath); err != nil {
+		return abandon(err)
+	}
+
+	if dispatcher.log != nil {
+		_ = dispatcher.log.Close()
+	}
+	dispatcher.log, dispatcher.records = compacted, records
+	for id, delivery := range dispatcher.deliveries {
+		if delivery.Status == DeliveryDelivered {
+			delete(dispatcher.deliveries, id)
+		}
+	}
+	dispatcher.unsaved = make(map[string]bool)
+	return nil
+}
+
+// maybeCompact compacts the log once enough has been appended to it; the mutex must be held
+// a failed compaction leaves the old log in place, to be tried again later
+func (dispatcher *WebhookDispatcher) maybeCompact() {
+	if dispatcher.records >= webhookCompactRecords && dispatcher.records > 2*len(dispatcher.deliveries) {
+		_ = dispatcher.compact()
+	}
+}
+
+// saveUnsaved persists the deliveries whose last change could not be, reporting whether all now are
+// the mutex must be held
+func (dispatcher *WebhookDispatcher) saveUnsaved() bool {
+	for id := range dispatcher.unsaved {
+		if delivery, ok := dispatcher.deliveries[id]; ok {
+			if err := dispatcher.persist(delivery); err != nil {
+				return false
+			}
+		}
+		delete(dispatcher.unsaved, id)
+	}
+	return true
+}
+
+// persist appends the current state of delivery to the log; the mutex must be held
+func (dispatcher *WebhookDispatcher) persist(delivery *WebhookDelivery) error {
+	record, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	if _, err := dispatcher.log.Write(append(record, '\n')); err != nil {
+		return err
+	}
+	dispatcher.records++
+	return dispatcher.log.Sync()
+}
+
+// Enqueue stores payload for delivery to target and returns the delivery's ID
+// the delivery is on disk when Enqueue returns
+func (dispatcher *WebhookDispatcher) Enqueue(target string, payload interface{}) (string, error) {
+	if _, err := url.ParseRequestURI(target); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	delivery := &WebhookDelivery{
+		ID:            newIdempotencyKey(),
+		URL:           target,
+		Payload:       data,
+		Status:        DeliveryPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if err := dispatcher.persist(delivery); err != nil {
+		return "", err
+	}
+	dispatcher.deliveries[delivery.ID] = delivery
+	dispatcher.maybeCompact()
+	dispatcher.signal()
+	return delivery.ID, nil
+}
+
+// Delivery returns a copy of the delivery with the given ID, including its attempt history
+// delivered webhooks are forgotten when the log is compacted, which also happens when the dispatcher is reopened
+func (dispatcher *WebhookDispatcher) Delivery(id string) (WebhookDelivery, bool) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	delivery, ok := dispatcher.deliveries[id]
+	if !ok {
+		return WebhookDelivery{}, false
+	}
+	return copyDelivery(delivery), true
+}
+
+// DeadLetters returns copies of the deliveries in the dead letter store, oldest first
+func (dispatcher *WebhookDispatcher) DeadLetters() []WebhookDelivery {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	var dead []WebhookDelivery
+	for _, delivery := range dispatcher.deliveries {
+		if delivery.Status == DeliveryDead {
+			dead = append(dead, copyDelivery(delivery))
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].CreatedAt.Before(dead[j].CreatedAt)
+	})
+	return dead
+}
+
+// Replay moves a dead delivery back to the queue, with a fresh set of attempts
+// its attempt history is kept
+func (dispatcher *WebhookDispatcher) Replay(id string) error {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	delivery, ok := dispatcher.deliveries[id]
+	if !ok {
+		return ErrDeliveryNotFound
+	}
+	if delivery.Status != DeliveryDead {
+		return fmt.Errorf("webhook delivery %s is %s, not dead", id, delivery.Status)
+	}
+
+	replayed := copyDelivery(delivery)
+	replayed.Status, replayed.Failures, replayed.NextAttemptAt = DeliveryPending, 0, time.Now()
+	if err := dispatcher.persist(&replayed); err != nil {
+		return err
+	}
+	dispatcher.deliveries[id] = &replayed
+	dispatcher.maybeCompact()
+	dispatcher.signal()
+	return nil
+}
+
+// Start begins delivering webhooks with Workers goroutines, until Stop is called
+func (dispatcher *WebhookDispatcher) Start() {
+	workers := dispatcher.Workers
+	if workers <= 0 {
+		workers = defaultWebhookWorkers
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher.mutex.Lock()
+	dispatcher.cancel = cancel
+	dispatcher.wake = make(chan struct{}, workers)
+	dispatcher.mutex.Unlock()
+
+	for idx := 0; idx < workers; idx++ {
+		dispatcher.workers.Add(1)
+		go dispatcher.work(ctx)
+	}
+}
+
+// Stop waits for deliveries in progress to finish, then closes the queue
+// deliveries still pending are sent when the queue is next opened and started
+func (dispatcher *WebhookDispatcher) Stop() error {
+	dispatcher.mutex.Lock()
+	cancel := dispatcher.cancel
+	dispatcher.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	dispatcher.workers.Wait()
+
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	var saveErr error
+	if !dispatcher.saveUnsaved() {
+		// a compaction writes every delivery afresh
+		saveErr = dispatcher.compact()
+	}
+	return errors.Join(saveErr, dispatcher.log.Close())
+}
+
+// signal wakes a worker to look for due deliveries; the mutex must be held
+func (dispatcher *WebhookDispatcher) signal() {
+	select {
+	case dispatcher.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work delivers due webhooks until ctx is done
+func (dispatcher *WebhookDispatcher) work(ctx context.Context) {
+	defer dispatcher.workers.Done()
+
+	for {
+		delivery, wait := dispatcher.claim()
+		if delivery != nil {
+			dispatcher.deliver(delivery)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-dispatcher.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// claim takes the most overdue pending delivery, or says how long until one is due
+// it first retries saving deliveries whose last change could not be persisted, and while that fails,
+// waits no longer than InitialBackoff before trying again
+func (dispatcher *WebhookDispatcher) claim() (*WebhookDelivery, time.Duration) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	maxWait := time.Minute
+	if !dispatcher.saveUnsaved() {
+		maxWait = durationOrDefault(dispatcher.InitialBackoff, defaultWebhookInitialBackoff)
+	}
+
+	now := time.Now()
+	var next *WebhookDelivery
+	for _, delivery := range dispatcher.deliveries {
+		if delivery.Status != DeliveryPending || dispatcher.inFlight[delivery.ID] {
+			continue
+		}
+		if next == nil || delivery.NextAttemptAt.Before(next.NextAttemptAt) {
+			next = delivery
+		}
+	}
+
+	if next == nil {
+		return nil, maxWait
+	}
+	if wait := next.NextAttemptAt.Sub(now); wait > 0 {
+		return nil, min(wait, maxWait)
+	}
+	dispatcher.inFlight[next.ID] = true
+	claimed := copyDelivery(next)
+	return &claimed, 0
+}
+
+// deliver makes one attempt to send delivery and records the outcome
+func (dispatcher *WebhookDispatcher) deliver(delivery *WebhookDelivery) {
+	attempt := DeliveryAttempt{At: time.Now()}
+	permanent := false
+
+	target, err := url.Parse(delivery.URL)
+	if err == nil {
+		var status int
+		_, status, err = dispatcher.tools.PostJSONToRemote(*target, delivery.Payload, dispatcher.HTTPClient)
+		attempt.StatusCode = status
+		if err == nil && (status < 200 || status > 299) {
+			err = fmt.Errorf("remote answered %d %s", status, http.StatusText(status))
+			permanent = status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+		}
+	}
+	attempt.Duration = time.Since(attempt.At)
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+	default:
+		delivery.Failures++
+
+		maxAttempts := dispatcher.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = defaultWebhookAttempts
+		}
+		if permanent || delivery.Failures >= maxAttempts {
+			delivery.Status = DeliveryDead
+			break
+		}
+
+		policy := RetryPolicy{InitialBackoff: dispatcher.InitialBackoff, MaxBackoff: dispatcher.MaxBackoff}
+		if policy.InitialBackoff <= 0 {
+			policy.InitialBackoff = defaultWebhookInitialBackoff
+		}
+		if policy.MaxBackoff <= 0 {
+			policy.MaxBackoff = defaultWebhookMaxBackoff
+		}
+		delivery.NextAttemptAt = time.Now().Add(policy.backoff(delivery.Failures))
+	}
+
+	dispatcher.mutex.Lock()
+	delete(dispatcher.inFlight, delivery.ID)
+	dispatcher.deliveries[delivery.ID] = delivery
+	if err := dispatcher.persist(delivery); err != nil {
+		// act on the outcome, rather than send the delivery again, and save it later; should the
+		// process end first, the delivery is sent again when the queue reopens
+		dispatcher.unsaved[delivery.ID] = true
+	} else {
+		dispatcher.maybeCompact()
+	}
+	dispatcher.mutex.Unlock()
+
+	if delivery.Status == DeliveryDead && dispatcher.OnDeadLetter != nil {
+		dispatcher.OnDeadLetter(copyDelivery(delivery))
+	}
+}
+
+// copyDelivery copies a delivery so callers can not change the queue's state
+func copyDelivery(delivery *WebhookDelivery) WebhookDelivery {
+	copied := *delivery
+	copied.Payload = append(json.RawMessage(nil), delivery.Payload...)
+	copied.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+	return copied
+}
@@ -0,0 +1,252 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver answers with status until healthy is set, then accepts webhooks
+type webhookReceiver struct {
+	status   int32
+	healthy  atomic.Bool
+	received atomic.Int32
+}
+
+func (receiver *webhookReceiver) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+	if !receiver.healthy.Load() {
+		responseWriter.WriteHeader(int(atomic.LoadInt32(&receiver.status)))
+		return
+	}
+	if !json.Valid(body) {
+		responseWriter.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	receiver.received.Add(1)
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func newTestDispatcher(test *testing.T, directory string) *WebhookDispatcher {
+	var testTools Tools
+	dispatcher, err := testTools.NewWebhookDispatcher(directory)
+	if err != nil {
+		test.Fatal(err)
+	}
+	dispatcher.Workers = 2
+	dispatcher.MaxAttempts = 3
+	dispatcher.InitialBackoff = 5 * time.Millisecond
+	dispatcher.MaxBackoff = 20 * time.Millisecond
+	return dispatcher
+}
+
+// waitForStatus polls until the delivery reaches status
+func waitForStatus(test *testing.T, dispatcher *WebhookDispatcher, id string, status DeliveryStatus) WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if delivery, ok := dispatcher.Delivery(id); ok && delivery.Status == status {
+			return delivery
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	delivery, _ := dispatcher.Delivery(id)
+	test.Fatalf("delivery %s did not become %s: %+v", id, status, delivery)
+	return delivery
+}
+
+func TestWebhookDispatcherRetries(test *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dispatcher := newTestDispatcher(test, test.TempDir())
+	dispatcher.MaxAttempts = 50
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	id, err := dispatcher.Enqueue(server.URL, map[string]string{"event": "paid"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	time.AfterFunc(8*time.Millisecond, func() { receiver.healthy.Store(true) })
+
+	delivery := waitForStatus(test, dispatcher, id, DeliveryDelivered)
+	if len(delivery.Attempts) < 2 || delivery.Attempts[0].StatusCode != http.StatusServiceUnavailable || delivery.Attempts[0].Error == "" {
+		test.Errorf("expected a failed attempt before the delivery but got %+v", delivery.Attempts)
+	}
+	if receiver.received.Load() != 1 {
+		test.Errorf("expected one webhook to be received but got %d", receiver.received.Load())
+	}
+}
+
+func TestWebhookDispatcherSurvivesRestart(test *testing.T) {
+	receiver := &webhookReceiver{}
+	receiver.healthy.Store(true)
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	directory := test.TempDir()
+
+	// enqueue without ever starting, as if the process stopped straight away
+	dispatcher := newTestDispatcher(test, directory)
+	id, err := dispatcher.Enqueue(server.URL, map[string]int{"order": 1})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := dispatcher.Stop(); err != nil {
+		test.Fatal(err)
+	}
+
+	restarted := newTestDispatcher(test, directory)
+	restarted.Start()
+	waitForStatus(test, restarted, id, DeliveryDelivered)
+	_ = restarted.Stop()
+
+	// delivered webhooks are compacted away and not sent again
+	reopened := newTestDispatcher(test, directory)
+	reopened.Start()
+	time.Sleep(20 * time.Millisecond)
+	_ = reopened.Stop()
+	if _, ok := reopened.Delivery(id); ok || receiver.received.Load() != 1 {
+		test.Errorf("expected the delivered webhook to be forgotten, received %d", receiver.received.Load())
+	}
+}
+
+func TestWebhookDispatcherDeadLetters(test *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	directory := test.TempDir()
+
+	var deadLetters atomic.Int32
+	dispatcher := newTestDispatcher(test, directory)
+	dispatcher.OnDeadLetter = func(delivery WebhookDelivery) { deadLetters.Add(1) }
+	dispatcher.Start()
+
+	exhausted, _ := dispatcher.Enqueue(server.URL, map[string]string{"event": "exhausted"})
+	delivery := waitForStatus(test, dispatcher, exhausted, DeliveryDead)
+	if len(delivery.Attempts) != 3 {
+		test.Errorf("expected 3 attempts but got %d", len(delivery.Attempts))
+	}
+
+	atomic.StoreInt32(&receiver.status, http.StatusGone)
+	gone, _ := dispatcher.Enqueue(server.URL, map[string]string{"event": "gone"})
+	delivery = waitForStatus(test, dispatcher, gone, DeliveryDead)
+	if len(delivery.Attempts) != 1 {
+		test.Errorf("expected a 410 to fail permanently after 1 attempt but got %d", len(delivery.Attempts))
+	}
+	_ = dispatcher.Stop()
+
+	// the dead letter store survives a restart and can be replayed
+	restarted := newTestDispatcher(test, directory)
+	defer restarted.Stop()
+	if dead := restarted.DeadLetters(); len(dead) != 2 || dead[0].ID != exhausted || deadLetters.Load() != 2 {
+		test.Fatalf("expected 2 dead letters but got %+v", dead)
+	}
+
+	receiver.healthy.Store(true)
+	restarted.Start()
+	if err := restarted.Replay(exhausted); err != nil {
+		test.Fatal(err)
+	}
+	delivery = waitForStatus(test, restarted, exhausted, DeliveryDelivered)
+	if len(delivery.Attempts) != 4 || delivery.Failures != 0 {
+		test.Errorf("expected the attempt history to be kept but got %+v", delivery)
+	}
+	if err := restarted.Replay(exhausted); err == nil {
+		test.Error("expected replaying a delivered webhook to fail")
+	}
+	if err := restarted.Replay("missing"); err != ErrDeliveryNotFound {
+		test.Errorf("expected ErrDeliveryNotFound but got %v", err)
+	}
+}
+
+func TestWebhookDispatcherPersistFailure(test *testing.T) {
+	receiver := &webhookReceiver{}
+	receiver.healthy.Store(true)
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	directory := test.TempDir()
+	dispatcher := newTestDispatcher(test, directory)
+	dispatcher.InitialBackoff = 50 * time.Millisecond
+	id, err := dispatcher.Enqueue(server.URL, map[string]string{"event": "paid"})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// the outcome of the delivery can not be written
+	_ = dispatcher.log.Close()
+	dispatcher.Start()
+	waitForStatus(test, dispatcher, id, DeliveryDelivered)
+	time.Sleep(200 * time.Millisecond)
+	if received := receiver.received.Load(); received != 1 {
+		test.Errorf("expected the delivered webhook to be sent once, got %d", received)
+	}
+
+	// Stop saves the outcome in a fresh log, so reopening does not send it again
+	if err := dispatcher.Stop(); err != nil {
+		test.Fatal(err)
+	}
+	reopened := newTestDispatcher(test, directory)
+	defer reopened.Stop()
+	if _, ok := reopened.Delivery(id); ok {
+		test.Error("expected the delivered webhook to be forgotten")
+	}
+}
+
+func TestWebhookDispatcherCompaction(test *testing.T) {
+	receiver := &webhookReceiver{}
+	receiver.healthy.Store(true)
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	directory := test.TempDir()
+	dispatcher := newTestDispatcher(test, directory)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	var ids []string
+	for idx := 0; idx < 5; idx++ {
+		id, err := dispatcher.Enqueue(server.URL, map[string]int{"event": idx})
+		if err != nil {
+			test.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		waitForStatus(test, dispatcher, id, DeliveryDelivered)
+	}
+
+	dispatcher.mutex.Lock()
+	records := dispatcher.records
+	err := dispatcher.compact()
+	remaining, compacted := len(dispatcher.deliveries), dispatcher.records
+	dispatcher.mutex.Unlock()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if records != 10 || remaining != 0 || compacted != 0 {
+		test.Errorf("expected 10 records compacted away, got %d records, %d deliveries and %d records left", records, remaining, compacted)
+	}
+
+	// the compacted log is still appended to
+	id, err := dispatcher.Enqueue(server.URL, map[string]string{"event": "after"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	waitForStatus(test, dispatcher, id, DeliveryDelivered)
+	log, err := os.ReadFile(filepath.Join(directory, webhookQueueFile))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if lines := strings.Count(string(log), "\n"); lines != 2 {
+		test.Errorf("expected the enqueue and delivery of the last webhook in the log, got %d lines", lines)
+	}
+}
@@ -0,0 +1,136 @@
+package toolkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var webhookSecret = []byte("whsec_test")
+
+func TestWebhookVerifier(test *testing.T) {
+	signedAt := time.Unix(1700000000, 0)
+	signer := WebhookSigner{Secret: webhookSecret, now: func() time.Time { return signedAt }}
+	body := []byte(`{"event":"paid"}`)
+	signature := signer.Signature(body)
+
+	// the same signature with its nonce moved from the header to the front of the body
+	timestampPart, rest, _ := strings.Cut(signature, ",")
+	noncePart, signaturePart, _ := strings.Cut(rest, ",")
+	withoutNonce := timestampPart + "," + signaturePart
+	nonceInBody := append([]byte(strings.TrimPrefix(noncePart, "n=")+"."), body...)
+
+	tests := []struct {
+		name      string
+		verifier  *WebhookVerifier
+		signature string
+		body      []byte
+		now       time.Time
+		expected  error
+	}{
+		{name: "valid", signature: signature, body: body, now: signedAt.Add(time.Minute)},
+		{name: "rotated secret", verifier: &WebhookVerifier{Secrets: [][]byte{[]byte("new"), webhookSecret}}, signature: signature, body: body, now: signedAt},
+		{name: "missing", signature: "", body: body, now: signedAt, expected: ErrWebhookSignatureMissing},
+		{name: "malformed", signature: "v1=abc", body: body, now: signedAt, expected: ErrWebhookSignatureInvalid},
+		{name: "no nonce", signature: withoutNonce, body: nonceInBody, now: signedAt, expected: ErrWebhookSignatureInvalid},
+		{name: "nonce with full stop", signature: timestampPart + ",n=a.b," + signaturePart, body: body, now: signedAt, expected: ErrWebhookSignatureInvalid},
+		{name: "tampered body", signature: signature, body: []byte(`{"event":"refunded"}`), now: signedAt, expected: ErrWebhookSignatureInvalid},
+		{name: "wrong secret", verifier: &WebhookVerifier{Secrets: [][]byte{[]byte("other")}}, signature: signature, body: body, now: signedAt, expected: ErrWebhookSignatureInvalid},
+		{name: "too old", signature: signature, body: body, now: signedAt.Add(6 * time.Minute), expected: ErrWebhookTimestamp},
+		{name: "from the future", signature: signature, body: body, now: signedAt.Add(-6 * time.Minute), expected: ErrWebhookTimestamp},
+	}
+
+	for _, entry := range tests {
+		verifier := entry.verifier
+		if verifier == nil {
+			verifier = &WebhookVerifier{Secrets: [][]byte{webhookSecret}}
+		}
+		now := entry.now
+		verifier.now = func() time.Time { return now }
+
+		if err := verifier.Verify(entry.signature, entry.body); !errors.Is(err, entry.expected) {
+			test.Errorf("%s: expected %v but got %v", entry.name, entry.expected, err)
+		}
+	}
+}
+
+func TestTools_VerifyWebhook(test *testing.T) {
+	var receiver Tools
+	var received []string
+	verifier := &WebhookVerifier{Secrets: [][]byte{webhookSecret}}
+	server := httptest.NewServer(receiver.VerifyWebhook(verifier, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		var event struct {
+			Event string `json:"event"`
+		}
+		if err := receiver.ReadJSON(responseWriter, request, &event); err != nil {
+			_ = receiver.ErrorJSON(responseWriter, err)
+			return
+		}
+		received = append(received, event.Event)
+		responseWriter.WriteHeader(http.StatusNoContent)
+	})))
+	defer server.Close()
+
+	sender := Tools{RemoteSigner: &WebhookSigner{Secret: webhookSecret}}
+	remoteURI, _ := url.Parse(server.URL)
+	response, status, err := sender.PostJSONToRemote(*remoteURI, map[string]string{"event": "paid"})
+	if err != nil || status != http.StatusNoContent || len(received) != 1 || received[0] != "paid" {
+		test.Fatalf("expected the signed webhook to be received but got %d, %v, %v", status, received, err)
+	}
+
+	// sending the same request again is a replay
+	replay, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{"event":"paid"}`))
+	replay.Header.Set(DefaultWebhookSignatureHeader, response.Request.Header.Get(DefaultWebhookSignatureHeader))
+	replayResponse, err := http.DefaultClient.Do(replay)
+	if err != nil {
+		test.Fatal(err)
+	}
+	_ = replayResponse.Body.Close()
+	if replayResponse.StatusCode != http.StatusUnauthorized || len(received) != 1 {
+		test.Errorf("expected the replay to be rejected but got %d", replayResponse.StatusCode)
+	}
+
+	unsigned := Tools{}
+	_, status, _ = unsigned.PostJSONToRemote(*remoteURI, map[string]string{"event": "paid"})
+	if status != http.StatusUnauthorized {
+		test.Errorf("expected an unsigned webhook to be rejected but got %d", status)
+	}
+
+	client, _ := NewJSONClient(server.URL)
+	client.Signer = &WebhookSigner{Secret: webhookSecret}
+	if _, err := client.Post(context.Background(), "/", map[string]string{"event": "shipped"}, nil); err != nil || len(received) != 2 {
+		test.Errorf("expected the client's signed webhook to be received but got %v", err)
+	}
+}
+
+func TestTools_VerifyWebhookRetried(test *testing.T) {
+	var receiver Tools
+	attempts := 0
+	verifier := &WebhookVerifier{Secrets: [][]byte{webhookSecret}}
+	server := httptest.NewServer(receiver.VerifyWebhook(verifier, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// verified, and so remembered, but failed afterwards
+			responseWriter.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		responseWriter.WriteHeader(http.StatusNoContent)
+	})))
+	defer server.Close()
+
+	// retries within the same second must still be signed afresh
+	sender := Tools{
+		RemoteSigner: &WebhookSigner{Secret: webhookSecret},
+		RemoteRetry:  &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+	remoteURI, _ := url.Parse(server.URL)
+	_, status, err := sender.PostJSONToRemote(*remoteURI, map[string]string{"event": "paid"})
+	if err != nil || status != http.StatusNoContent || attempts != 2 {
+		test.Errorf("expected the retry to be accepted but got %d after %d attempts, %v", status, attempts, err)
+	}
+}